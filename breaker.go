@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorRateBreaker trips when the share of failed upstream requests in a window
+// exceeds a threshold, and lets requests through again after one window
+type errorRateBreaker struct {
+	threshold   float64
+	window      time.Duration
+	minRequests int
+	now         func() time.Time
+
+	// failureStatus holds the failure_status_codes; when empty every 5xx is a failure
+	failureStatus map[int]bool
+
+	mu           sync.Mutex
+	windowStart  time.Time
+	total        int
+	failed       int
+	trippedUntil time.Time
+}
+
+// newErrorRateBreaker returns a breaker for the service, or nil if error_rate_threshold is unset
+func newErrorRateBreaker(config *ServiceConfig) *errorRateBreaker {
+	if config.ErrorRateThreshold <= 0 {
+		return nil
+	}
+	minRequests := config.ErrorRateMinRequests
+	if minRequests <= 0 {
+		minRequests = defaultErrorRateMinRequests
+	}
+	var failureStatus map[int]bool
+	if len(config.FailureStatusCodes) > 0 {
+		failureStatus = make(map[int]bool, len(config.FailureStatusCodes))
+		for _, code := range config.FailureStatusCodes {
+			failureStatus[code] = true
+		}
+	}
+	return &errorRateBreaker{
+		threshold:     config.ErrorRateThreshold,
+		window:        durationValue(config.ErrorRateWindow, defaultErrorRateWindow),
+		minRequests:   minRequests,
+		now:           time.Now,
+		failureStatus: failureStatus,
+	}
+}
+
+// isFailure reports whether an upstream response with the status code counts
+// against the breaker, so e.g. a 401 for bad credentials doesn't trip it
+func (b *errorRateBreaker) isFailure(status int) bool {
+	if b == nil {
+		return false
+	}
+	if b.failureStatus != nil {
+		return b.failureStatus[status]
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// allow reports whether requests may be forwarded, i.e. the breaker isn't tripped
+func (b *errorRateBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.now().Before(b.trippedUntil)
+}
+
+// record counts a finished request and reports whether it tripped the breaker
+func (b *errorRateBreaker) record(failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart, b.total, b.failed = now, 0, 0
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+
+	if b.total < b.minRequests || float64(b.failed)/float64(b.total) <= b.threshold {
+		return false
+	}
+	// Start counting afresh once requests are let through again
+	b.trippedUntil = now.Add(b.window)
+	b.windowStart, b.total, b.failed = b.trippedUntil, 0, 0
+	return true
+}
+
+// Tripped reports whether the breaker is currently rejecting requests
+func (b *errorRateBreaker) Tripped() bool {
+	return b != nil && !b.allow()
+}
+
+// recordResult feeds the outcome of a forwarded request to the proxy's breaker, if any
+func (p *Proxy) recordResult(failed bool) {
+	if p.breaker != nil && p.breaker.record(failed) {
+		p.logf(levelWarn, "Error rate for %s exceeded %.0f%%, rejecting requests for %s",
+			p.config.NodeName, p.breaker.threshold*100, p.breaker.window)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestErrorRateBreaker(t *testing.T) {
+	if b := newErrorRateBreaker(&ServiceConfig{}); b != nil {
+		t.Fatalf("newErrorRateBreaker() without threshold = %v, want nil", b)
+	}
+
+	now := time.Now()
+	b := newErrorRateBreaker(&ServiceConfig{
+		ErrorRateThreshold:   0.5,
+		ErrorRateWindow:      Duration(time.Minute),
+		ErrorRateMinRequests: 4,
+	})
+	b.now = func() time.Time { return now }
+
+	// Failures below the minimum request count don't trip the breaker
+	for i := 0; i < 3; i++ {
+		if b.record(true) {
+			t.Fatalf("record() tripped after %d requests, want at least 4", i+1)
+		}
+	}
+	if !b.record(true) {
+		t.Fatal("record() did not trip with every request failing")
+	}
+	if !b.Tripped() || b.allow() {
+		t.Error("breaker allows requests right after tripping")
+	}
+
+	// Requests are let through again after one window, with fresh counts
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Error("breaker still rejects requests after the window")
+	}
+	for i := 0; i < 4; i++ {
+		if b.record(i%2 == 0) {
+			t.Fatalf("record() tripped at a 50%% error rate, want only above it")
+		}
+	}
+}
+
+func TestErrorRateBreakerFailureStatusCodes(t *testing.T) {
+	var b *errorRateBreaker
+	if b.isFailure(http.StatusInternalServerError) {
+		t.Error("isFailure() without a breaker = true, want false")
+	}
+
+	tests := []struct {
+		name   string
+		codes  []int
+		status int
+		want   bool
+	}{
+		{"default 5xx", nil, http.StatusBadGateway, true},
+		{"default 4xx", nil, http.StatusUnauthorized, false},
+		{"default 2xx", nil, http.StatusOK, false},
+		{"listed code", []int{502, 503}, http.StatusServiceUnavailable, true},
+		{"unlisted 5xx", []int{502, 503}, http.StatusInternalServerError, false},
+		{"listed 4xx", []int{429}, http.StatusTooManyRequests, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newErrorRateBreaker(&ServiceConfig{ErrorRateThreshold: 0.5, FailureStatusCodes: tt.codes})
+			if got := b.isFailure(tt.status); got != tt.want {
+				t.Errorf("isFailure(%d) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
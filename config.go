@@ -3,20 +3,58 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 )
 
 // Config represents the main configuration structure
 type Config struct {
+	// Version is the config schema version; older configs are migrated on load
+	Version   int             `json:"version,omitempty"`
 	Tailscale TailscaleConfig `json:"tailscale"`
 	Services  []ServiceConfig `json:"services"`
 	Docker    DockerConfig    `json:"docker,omitempty"`
+	Defaults  DefaultsConfig  `json:"defaults,omitempty"`
+}
+
+// DefaultsConfig holds settings applied to every service and discovered
+// container that doesn't set them itself
+type DefaultsConfig struct {
+	PassHostHeader     *bool    `json:"pass_host_header,omitempty"`
+	TrustForwardHeader *bool    `json:"trust_forward_header,omitempty"`
+	StartRetries       *int     `json:"start_retries,omitempty"`
+	StartRetryBackoff  Duration `json:"start_retry_backoff,omitempty"`
+	LogDedupWindow     Duration `json:"log_dedup_window,omitempty"`
+	JitterFraction     *float64 `json:"jitter_fraction,omitempty"`
 }
 
 // TailscaleConfig holds global Tailscale settings
 type TailscaleConfig struct {
-	AuthKey   string `json:"auth_key"`
-	Ephemeral bool   `json:"ephemeral"`
+	AuthKey     string `json:"auth_key"`
+	AuthKeyFile string `json:"auth_key_file,omitempty"`
+	Ephemeral   bool   `json:"ephemeral"`
+
+	// OAuthClientID and OAuthClientSecret identify a Tailscale OAuth client used
+	// to mint a short-lived auth key, tagged with OAuthTags, for each new node
+	OAuthClientID         string   `json:"oauth_client_id,omitempty"`
+	OAuthClientSecret     string   `json:"oauth_client_secret,omitempty"`
+	OAuthClientSecretFile string   `json:"oauth_client_secret_file,omitempty"`
+	OAuthTags             []string `json:"oauth_tags,omitempty"`
+
+	// ControlURL selects a coordination server other than Tailscale's, such as Headscale
+	ControlURL string `json:"control_url,omitempty"`
+
+	// StateDir is where each node's tsnet state is kept, in a subdirectory
+	// named after the node (default ~/.config/webtail)
+	StateDir string `json:"state_dir,omitempty"`
 }
 
 // DockerConfig holds Docker client settings
@@ -26,37 +64,542 @@ type DockerConfig struct {
 	APIVersion string `json:"api_version,omitempty"`
 	CertPath   string `json:"cert_path,omitempty"`
 	TLSVerify  *bool  `json:"tls_verify,omitempty"`
+
+	// InferProtocolFromPort selects https for well-known TLS ports when
+	// the webtail.protocol label is absent
+	InferProtocolFromPort bool `json:"infer_protocol_from_port,omitempty"`
+
+	// WaitForHealthy delays proxy creation for containers with a HEALTHCHECK
+	// until Docker reports them healthy
+	WaitForHealthy bool `json:"wait_for_healthy,omitempty"`
+
+	// RequireInitialScan makes a failed scan of already-running containers
+	// fatal (after retrying) instead of only logging a warning
+	RequireInitialScan bool `json:"require_initial_scan,omitempty"`
+
+	// FallbackPorts are probed, in order, for containers without a port label
+	// or exposed ports; the first port accepting connections becomes the target
+	FallbackPorts []int `json:"fallback_ports,omitempty"`
+
+	// IgnoreExisting skips the startup scan of already-running containers,
+	// so only containers started while webtail runs get a proxy
+	IgnoreExisting bool `json:"ignore_existing,omitempty"`
+
+	// RequireNetwork refuses to start discovery when Network doesn't exist
+	// instead of only logging an error
+	RequireNetwork bool `json:"require_network,omitempty"`
+
+	// UsePublishedPorts targets the ports containers publish to the host,
+	// reached via PublishedHost, instead of the container on Network
+	UsePublishedPorts bool   `json:"use_published_ports,omitempty"`
+	PublishedHost     string `json:"published_host,omitempty"`
+
+	// LabelPrefix is the namespace of the container labels webtail reads,
+	// e.g. "tailnet" for tailnet.enabled (default webtail)
+	LabelPrefix string `json:"label_prefix,omitempty"`
+
+	// TriggerEvents are the container events that create a proxy
+	// (create, start, restart or unpause; default start)
+	TriggerEvents []string `json:"trigger_events,omitempty"`
+
+	// EventWorkers is how many container events are handled concurrently and
+	// EventRate caps how many are handled per second; excess events are queued
+	EventWorkers int     `json:"event_workers,omitempty"`
+	EventRate    float64 `json:"event_rate,omitempty"`
+
+	// StripNamePrefixes and StripNameSuffixes are removed from container names
+	// used as node names (the first match of each), e.g. a compose project
+	// prefix "myproject-" and replica suffix "-1"
+	StripNamePrefixes []string `json:"strip_name_prefixes,omitempty"`
+	StripNameSuffixes []string `json:"strip_name_suffixes,omitempty"`
+
+	// AllowedNodeNames restricts discovered containers to these node names;
+	// containers resolving to any other name are skipped
+	AllowedNodeNames []string `json:"allowed_node_names,omitempty"`
+
+	// IncludeStates are the container states eligible for a proxy (created,
+	// running, paused or restarting; default any running container)
+	IncludeStates []string `json:"include_states,omitempty"`
+
+	// SweepInterval periodically checks the proxies of discovered containers,
+	// removing those missed by stop events: proxies that have been unhealthy
+	// for SweepGrace and whose container no longer exists
+	SweepInterval Duration `json:"sweep_interval,omitempty"`
+	SweepGrace    Duration `json:"sweep_grace,omitempty"`
+
+	// MaxConcurrentStarts bounds how many container proxies are brought up at
+	// once; the rest wait for a free slot
+	MaxConcurrentStarts int `json:"max_concurrent_starts,omitempty"`
+
+	// ReuseState keeps discovered nodes' state even when tailscale.ephemeral
+	// is set, so a container recreated with the same node name comes back as
+	// the same machine instead of registering a new one
+	ReuseState bool `json:"reuse_state,omitempty"`
+
+	// LogoutOnStop logs discovered nodes out of the tailnet when webtail shuts
+	// down, so non-ephemeral nodes don't linger as offline devices
+	LogoutOnStop bool `json:"logout_on_stop,omitempty"`
+
+	// LocalNodeOnly ignores Swarm task containers scheduled on other nodes
+	LocalNodeOnly bool `json:"local_node_only,omitempty"`
+
+	// HostID identifies this webtail instance; containers whose webtail.host
+	// label names a different host are ignored
+	HostID string `json:"host_id,omitempty"`
+
+	// PreferNetworkAlias builds targets from a container's network alias
+	// instead of its name; NetworkAliasPattern restricts which aliases qualify
+	PreferNetworkAlias  bool   `json:"prefer_network_alias,omitempty"`
+	NetworkAliasPattern string `json:"network_alias_pattern,omitempty"`
 }
 
 // ServiceConfig represents configuration for a single service
 type ServiceConfig struct {
-	Target             string `json:"target"`
-	NodeName           string `json:"node_name"`
-	PassHostHeader     *bool  `json:"pass_host_header,omitempty"`
-	TrustForwardHeader *bool  `json:"trust_forward_header,omitempty"`
+	Target              string `json:"target"`
+	NodeName            string `json:"node_name"`
+	PassHostHeader      *bool  `json:"pass_host_header,omitempty"`
+	TrustForwardHeader  *bool  `json:"trust_forward_header,omitempty"`
+	NoCache             *bool  `json:"no_cache,omitempty"`
+	CacheControl        string `json:"cache_control,omitempty"`
+	SourceAddr          string `json:"source_addr,omitempty"`
+	ForwardOriginalHost *bool  `json:"forward_original_host,omitempty"`
+	OriginalHostHeader  string `json:"original_host_header,omitempty"`
+	LogLevel            string `json:"log_level,omitempty"`
+
+	// HTTPProxy is an http or https proxy URL, and SOCKS5Proxy a socks5 or
+	// socks5h one, the target is reached through; hosts matching NoProxy
+	// (host names, domain suffixes, IPs or CIDRs) are dialed directly.
+	// Either URL can instead be read from the file named by its _file field.
+	HTTPProxy       string   `json:"http_proxy,omitempty"`
+	HTTPProxyFile   string   `json:"http_proxy_file,omitempty"`
+	SOCKS5Proxy     string   `json:"socks5_proxy,omitempty"`
+	SOCKS5ProxyFile string   `json:"socks5_proxy_file,omitempty"`
+	NoProxy         []string `json:"no_proxy,omitempty"`
+
+	// Labels is arbitrary metadata, such as owner or environment, reported
+	// with the proxy's status
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// LogFile writes this proxy's logs to a file instead of stderr; "{node_name}"
+	// is replaced by the node name. The file is rotated once it reaches
+	// LogMaxSize megabytes or LogMaxAge, and reopened on SIGHUP. Only the
+	// newest LogMaxBackups rotated files are kept; 0 keeps all of them.
+	LogFile       string   `json:"log_file,omitempty"`
+	LogMaxSize    int      `json:"log_max_size,omitempty"`
+	LogMaxAge     Duration `json:"log_max_age,omitempty"`
+	LogMaxBackups *int     `json:"log_max_backups,omitempty"`
+
+	// RespectRetryAfter holds and retries requests answered with 503 and a
+	// Retry-After header, waiting at most RetryAfterMaxWait in total
+	RespectRetryAfter *bool    `json:"respect_retry_after,omitempty"`
+	RetryAfterMaxWait Duration `json:"retry_after_max_wait,omitempty"`
+
+	// MaxConcurrentRequests caps the requests forwarded at once; requests over
+	// the cap wait up to QueueTimeout for a slot before getting a 503
+	MaxConcurrentRequests int      `json:"max_concurrent_requests,omitempty"`
+	QueueTimeout          Duration `json:"queue_timeout,omitempty"`
+
+	// FirstRequestRetries retries failed upstream dials this many times, with
+	// a short backoff, until the proxy has connected to the target once
+	FirstRequestRetries int `json:"first_request_retries,omitempty"`
+
+	// RetryBudget caps retries (first_request_retries and respect_retry_after)
+	// to this share (0-1) of original requests, e.g. 0.1 for 10%
+	RetryBudget float64 `json:"retry_budget,omitempty"`
+
+	// ErrorRateThreshold is the share (0-1) of failed upstream requests within
+	// ErrorRateWindow above which the proxy returns 503 for one window, once at
+	// least ErrorRateMinRequests were made
+	ErrorRateThreshold   float64  `json:"error_rate_threshold,omitempty"`
+	ErrorRateWindow      Duration `json:"error_rate_window,omitempty"`
+	ErrorRateMinRequests int      `json:"error_rate_min_requests,omitempty"`
+
+	// FailureStatusCodes are the upstream response codes counted as failures
+	// by the error-rate breaker instead of every 5xx, e.g. [500, 502, 503, 504]
+	FailureStatusCodes []int `json:"failure_status_codes,omitempty"`
+
+	// StartRetries is how many times a failed proxy start is retried, waiting
+	// StartRetryBackoff before the first retry and doubling it each time
+	StartRetries      *int     `json:"start_retries,omitempty"`
+	StartRetryBackoff Duration `json:"start_retry_backoff,omitempty"`
+
+	// LogDedupWindow collapses a start error repeated within this window of
+	// when it was last logged into a count of its repeats
+	LogDedupWindow Duration `json:"log_dedup_window,omitempty"`
+
+	// MaxConnLifetime closes idle upstream connections this often so they are
+	// re-dialed, e.g. to follow a recreated container's new IP
+	MaxConnLifetime Duration `json:"max_conn_lifetime,omitempty"`
+
+	// JitterFraction varies the interval of periodic work such as
+	// MaxConnLifetime by up to this share, so proxies don't act in lockstep
+	JitterFraction *float64 `json:"jitter_fraction,omitempty"`
+
+	// ClientCertFile and ClientKeyFile hold a PEM client certificate
+	// presented to upstreams that require mutual TLS
+	ClientCertFile string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string `json:"client_key_file,omitempty"`
+
+	// ErrorResponses maps upstream error classes (dial, timeout, tls) to
+	// the response sent to the client instead of the default 502/504
+	ErrorResponses map[string]ErrorResponse `json:"error_responses,omitempty"`
+
+	// PathRoutes maps URL path prefixes to targets; the longest matching
+	// prefix wins and unmatched paths go to Target, or 404 if it is empty
+	PathRoutes      map[string]string `json:"path_routes,omitempty"`
+	StripPathPrefix *bool             `json:"strip_path_prefix,omitempty"`
+
+	// HeaderRoutes select a target by request header, e.g. an API version;
+	// the first matching route wins, ahead of path_routes and target
+	HeaderRoutes []HeaderRoute `json:"header_routes,omitempty"`
+
+	// CancelUpstreamOnClientDisconnect cancels the upstream request when the
+	// client goes away (default); disable it for backends that must complete
+	// side-effecting requests once started
+	CancelUpstreamOnClientDisconnect *bool `json:"cancel_upstream_on_client_disconnect,omitempty"`
+
+	// RootRedirect redirects requests for / to this path, e.g. /dashboard,
+	// for backends that don't serve their root
+	RootRedirect string `json:"root_redirect,omitempty"`
+
+	// RedirectTrailingSlash redirects a request for a path_routes prefix
+	// without its trailing slash, e.g. /grafana, to /grafana/
+	RedirectTrailingSlash *bool `json:"redirect_trailing_slash,omitempty"`
+
+	// Listeners serve additional targets on other ports of the same node;
+	// path_routes and other settings apply to every listener
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+
+	// RewriteRules rewrite the request path with regular expressions, in
+	// order, after path routing
+	RewriteRules []RewriteRule `json:"rewrite_rules,omitempty"`
+
+	// QueryParams are added to every upstream request, replacing parameters
+	// of the same name sent by the client, e.g. an API key. QueryParamFiles
+	// maps parameter names to files holding their values.
+	QueryParams     map[string]string `json:"query_params,omitempty"`
+	QueryParamFiles map[string]string `json:"query_param_files,omitempty"`
+
+	// FallbackTarget receives requests that fail because the target can't be
+	// reached, e.g. a maintenance server
+	FallbackTarget string `json:"fallback_target,omitempty"`
+
+	// CORS makes the proxy answer preflight requests and add CORS headers to
+	// responses, for backends that don't support cross-origin requests
+	CORS *CORSConfig `json:"cors,omitempty"`
+
+	// ServeNodeStatus answers StatusPathPrefix + /health and /status on the
+	// node itself instead of forwarding them to the backend
+	ServeNodeStatus  *bool  `json:"serve_node_status,omitempty"`
+	StatusPathPrefix string `json:"status_path_prefix,omitempty"`
+
+	// LocalHealthPath is answered by the proxy with its view of the backend's
+	// health (200 or 503 and a JSON body) instead of being forwarded
+	LocalHealthPath string `json:"local_health_path,omitempty"`
+
+	// RedirectMode controls upstream redirects: pass them through (default),
+	// follow them to the same upstream, or rewrite their Location to the node
+	RedirectMode string `json:"redirect_mode,omitempty"`
+
+	// ExposeUpstreamCert adds the subject and expiry of an https target's
+	// certificate to every response
+	ExposeUpstreamCert *bool `json:"expose_upstream_cert,omitempty"`
+
+	// ServerTiming appends upstream and total proxy durations to responses'
+	// Server-Timing header, where browser devtools show them
+	ServerTiming *bool `json:"server_timing,omitempty"`
+
+	// MirrorTarget receives a copy of each GET, HEAD and OPTIONS request, e.g. a
+	// new backend version; its responses are discarded
+	MirrorTarget string `json:"mirror_target,omitempty"`
+
+	// ControlURL overrides the Tailscale control_url for this node
+	ControlURL string `json:"control_url,omitempty"`
+
+	// ProvisionCertOnStart fetches the node's TLS certificate right after it
+	// comes up instead of on the first HTTPS request
+	ProvisionCertOnStart *bool `json:"provision_cert_on_start,omitempty"`
+
+	// WarmupPath is requested from the target once the node is up, so backends
+	// that are slow on their first request are warm for the first visitor
+	WarmupPath string `json:"warmup_path,omitempty"`
+
+	// StreamResponses flushes response data to the client every FlushInterval
+	// instead of when the server's write buffer fills up
+	StreamResponses *bool    `json:"stream_responses,omitempty"`
+	FlushInterval   Duration `json:"flush_interval,omitempty"`
+
+	// ResponseBufferSize is the size in bytes of the buffer each response is
+	// copied through, bounding per-request memory for large downloads
+	ResponseBufferSize int `json:"response_buffer_size,omitempty"`
+}
+
+// CORSConfig configures the CORS headers a proxy adds for browser clients on other origins
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	AllowCredentials *bool    `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+// ErrorResponse is the response returned to clients for an upstream error class
+type ErrorResponse struct {
+	Status int    `json:"status"`
+	Body   string `json:"body,omitempty"`
 }
 
+// ListenerConfig forwards HTTPS requests on a port of the node to a target
+type ListenerConfig struct {
+	Port   int    `json:"port"`
+	Target string `json:"target"`
+}
+
+// HeaderRoute sends requests whose Header has Value to Target; an empty
+// Value matches any request sending the header
+type HeaderRoute struct {
+	Header string `json:"header"`
+	Value  string `json:"value,omitempty"`
+	Target string `json:"target"`
+}
+
+// RewriteRule replaces matches of Pattern in the request path with Replacement,
+// which may refer to capture groups as $1 or ${name}
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Duration is a time.Duration that is configured as a string such as "10s"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", value, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// durationValue returns the duration or default if unset
+func durationValue(d Duration, defaultVal time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultVal
+	}
+	return time.Duration(d)
+}
+
+// stdinConfigPath is the -config value that reads the configuration from stdin
+const stdinConfigPath = "-"
+
 // LoadConfig reads and parses the configuration file
 func LoadConfig(configPath string, dockerEnabled bool) (*Config, error) {
+	if configPath == stdinConfigPath {
+		return parseConfig(os.Stdin, dockerEnabled)
+	}
+	if isRemoteConfig(configPath) {
+		return loadRemoteConfig(configPath, dockerEnabled)
+	}
+
 	file, err := os.Open(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open config file: %w", err)
 	}
 	defer file.Close()
 
+	return parseConfig(file, dockerEnabled)
+}
+
+// parseConfig decodes and validates a JSON configuration
+func parseConfig(r io.Reader, dockerEnabled bool) (*Config, error) {
 	var config Config
-	decoder := json.NewDecoder(file)
+	decoder := json.NewDecoder(r)
 	if err := decoder.Decode(&config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	warnings, err := migrateConfig(&config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+	}
+
+	if err := resolveSecrets(&config); err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets: %w", err)
+	}
+
 	if err := validateConfig(&config, dockerEnabled); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
+	applyDefaults(&config)
+
 	return &config, nil
 }
 
+// labelPrefixPattern matches the label namespaces Docker recommends, e.g. com.example
+var labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+const (
+	// defaultCacheControl is the Cache-Control value injected when no_cache is set
+	defaultCacheControl = "no-store"
+
+	// defaultRetryAfterMaxWait caps how long a request is held for Retry-After
+	defaultRetryAfterMaxWait = 10 * time.Second
+
+	// minRetryAfterDelay is the shortest wait between Retry-After retries, and
+	// maxRetryAfterAttempts caps them regardless of retry_after_max_wait
+	minRetryAfterDelay    = 100 * time.Millisecond
+	maxRetryAfterAttempts = 10
+
+	// certProvisionTimeout bounds proactive certificate provisioning
+	certProvisionTimeout = 2 * time.Minute
+
+	// fallbackPortProbeTimeout bounds each connection attempt to a docker.fallback_ports port
+	fallbackPortProbeTimeout = 2 * time.Second
+
+	// fallbackPortProbeAttempts and fallbackPortProbeInterval control how often
+	// docker.fallback_ports are probed while a new container starts listening
+	fallbackPortProbeAttempts = 5
+	fallbackPortProbeInterval = 3 * time.Second
+
+	// sweepProbeTimeout bounds the connection attempt to a proxy's target during a sweep
+	sweepProbeTimeout = 2 * time.Second
+
+	// defaultJitterFraction is how much periodic intervals vary by default
+	defaultJitterFraction = 0.1
+
+	// defaultSweepGrace is how long a proxy must be unhealthy before a sweep removes it
+	defaultSweepGrace = 5 * time.Minute
+
+	// logoutTimeout bounds logging a node out of the tailnet on shutdown
+	logoutTimeout = 10 * time.Second
+
+	// defaultFlushInterval is how often streamed responses are flushed
+	defaultFlushInterval = 100 * time.Millisecond
+
+	// firstDialRetryDelay is the initial backoff between first_request_retries
+	firstDialRetryDelay = 100 * time.Millisecond
+
+	// maxFirstRequestRetries caps first_request_retries; the backoff doubles each time
+	maxFirstRequestRetries = 10
+
+	// retryBudgetBurst is how many retries a retry_budget can bank, which also
+	// lets services with little traffic retry
+	retryBudgetBurst = 10
+
+	// defaultErrorRateWindow is the window error_rate_threshold is evaluated over
+	defaultErrorRateWindow = time.Minute
+
+	// defaultErrorRateMinRequests keeps a handful of failures from tripping the breaker
+	defaultErrorRateMinRequests = 20
+
+	// defaultStatusPathPrefix is where serve_node_status answers on each node
+	defaultStatusPathPrefix = "/.webtail"
+
+	// defaultStartRetryBackoff is the wait before the first start retry
+	defaultStartRetryBackoff = 5 * time.Second
+
+	// defaultLogMaxBackups is how many rotated log files are kept per service
+	defaultLogMaxBackups = 10
+
+	// upstreamCertSubjectHeader and upstreamCertNotAfterHeader carry the
+	// target's certificate details when expose_upstream_cert is set
+	upstreamCertSubjectHeader  = "X-Upstream-Cert-Subject"
+	upstreamCertNotAfterHeader = "X-Upstream-Cert-Not-After"
+
+	// mirrorTimeout bounds each mirrored request
+	mirrorTimeout = 30 * time.Second
+
+	// maxConcurrentMirrors bounds mirrored requests in flight per service
+	maxConcurrentMirrors = 64
+
+	// warmupTimeout bounds the warm-up request sent when warmup_path is set
+	warmupTimeout = time.Minute
+
+	// maxResponseBufferSize caps response_buffer_size so a typo can't exhaust memory
+	maxResponseBufferSize = 16 << 20
+)
+
+// supportedSchemes lists the target URL schemes webtail can proxy to
+var supportedSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+}
+
+// parseTarget parses a target URL, defaulting to http if no scheme is provided
+func parseTarget(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("target %q is not a valid URL: %w", target, err)
+	}
+	if !supportedSchemes[targetURL.Scheme] {
+		return nil, fmt.Errorf("target %q has unsupported scheme %q (must be http or https)", target, targetURL.Scheme)
+	}
+	if targetURL.Host == "" {
+		return nil, fmt.Errorf("target %q is missing a host", target)
+	}
+
+	return targetURL, nil
+}
+
+// validateControlURL checks that an optional control server URL is an absolute http(s) URL
+func validateControlURL(controlURL string) error {
+	if controlURL == "" {
+		return nil
+	}
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return fmt.Errorf("control_url %q is not a valid URL: %w", controlURL, err)
+	}
+	if !supportedSchemes[u.Scheme] || u.Host == "" {
+		return fmt.Errorf("control_url %q must be an absolute http or https URL", controlURL)
+	}
+	return nil
+}
+
+// applyDefaults fills in service settings left unset from the defaults section
+func applyDefaults(config *Config) {
+	for i := range config.Services {
+		service := &config.Services[i]
+		if service.PassHostHeader == nil {
+			service.PassHostHeader = config.Defaults.PassHostHeader
+		}
+		if service.TrustForwardHeader == nil {
+			service.TrustForwardHeader = config.Defaults.TrustForwardHeader
+		}
+		if service.StartRetries == nil {
+			service.StartRetries = config.Defaults.StartRetries
+		}
+		if service.StartRetryBackoff == 0 {
+			service.StartRetryBackoff = config.Defaults.StartRetryBackoff
+		}
+		if service.LogDedupWindow == 0 {
+			service.LogDedupWindow = config.Defaults.LogDedupWindow
+		}
+		if service.JitterFraction == nil {
+			service.JitterFraction = config.Defaults.JitterFraction
+		}
+	}
+}
+
 // boolValue returns the bool value or default if nil
 func boolValue(ptr *bool, defaultVal bool) bool {
 	if ptr == nil {
@@ -65,10 +608,59 @@ func boolValue(ptr *bool, defaultVal bool) bool {
 	return *ptr
 }
 
+// floatValue returns the float64 value or default if nil
+func floatValue(ptr *float64, defaultVal float64) float64 {
+	if ptr == nil {
+		return defaultVal
+	}
+	return *ptr
+}
+
+// intValue returns the int value or default if nil
+func intValue(ptr *int, defaultVal int) int {
+	if ptr == nil {
+		return defaultVal
+	}
+	return *ptr
+}
+
 // validateConfig checks if the configuration is valid
 func validateConfig(config *Config, dockerEnabled bool) error {
-	if config.Tailscale.AuthKey == "" {
-		return fmt.Errorf("tailscale auth_key is required")
+	if config.Tailscale.usesOAuth() {
+		if config.Tailscale.OAuthClientSecret == "" {
+			return fmt.Errorf("tailscale oauth_client_secret is required with oauth_client_id")
+		}
+		if len(config.Tailscale.OAuthTags) == 0 {
+			return fmt.Errorf("tailscale oauth_tags is required with oauth_client_id")
+		}
+		if config.Tailscale.ControlURL != "" {
+			return fmt.Errorf("tailscale oauth_client_id is not supported with control_url")
+		}
+	} else if config.Tailscale.OAuthClientSecret != "" {
+		return fmt.Errorf("tailscale oauth_client_secret requires oauth_client_id")
+	}
+
+	// Nodes that registered on a previous run reconnect with their saved state
+	if config.Tailscale.AuthKey == "" && !config.Tailscale.usesOAuth() {
+		for _, service := range config.Services {
+			if !config.Tailscale.canJoin(service.NodeName) {
+				return fmt.Errorf("tailscale auth_key is required (node %q has no saved state)", service.NodeName)
+			}
+		}
+		if len(config.Services) == 0 && !dockerEnabled {
+			return fmt.Errorf("tailscale auth_key is required")
+		}
+	}
+
+	if intValue(config.Defaults.StartRetries, 0) < 0 {
+		return fmt.Errorf("defaults.start_retries must not be negative")
+	}
+	if fraction := floatValue(config.Defaults.JitterFraction, 0); fraction < 0 || fraction >= 1 {
+		return fmt.Errorf("defaults.jitter_fraction must be at least 0 and less than 1")
+	}
+
+	if err := validateControlURL(config.Tailscale.ControlURL); err != nil {
+		return fmt.Errorf("tailscale: %w", err)
 	}
 
 	// Services are optional when Docker discovery is enabled
@@ -76,18 +668,220 @@ func validateConfig(config *Config, dockerEnabled bool) error {
 		return fmt.Errorf("at least one service must be configured (or use -docker flag)")
 	}
 
-	// Docker network is required when Docker discovery is enabled
-	if dockerEnabled && config.Docker.Network == "" {
+	// Docker network is required when Docker discovery is enabled, unless targets use published ports
+	if dockerEnabled && config.Docker.Network == "" && !config.Docker.UsePublishedPorts {
 		return fmt.Errorf("docker.network is required when using -docker flag")
 	}
+	if prefix := config.Docker.LabelPrefix; prefix != "" && !labelPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("docker.label_prefix: invalid prefix %q (use lowercase letters, digits, dots and dashes)", prefix)
+	}
+	for _, event := range config.Docker.TriggerEvents {
+		if !triggerEventNames[event] {
+			return fmt.Errorf("docker.trigger_events: unknown event %q (must be create, start, restart or unpause)", event)
+		}
+	}
+	for _, state := range config.Docker.IncludeStates {
+		if !discoveryStates[state] {
+			return fmt.Errorf("docker.include_states: unknown state %q (must be created, running, paused or restarting)", state)
+		}
+	}
+	if config.Docker.EventWorkers < 0 || config.Docker.EventRate < 0 {
+		return fmt.Errorf("docker.event_workers and docker.event_rate must not be negative")
+	}
+	if config.Docker.SweepGrace < 0 {
+		return fmt.Errorf("docker.sweep_grace must not be negative")
+	}
+	if config.Docker.SweepGrace != 0 && config.Docker.SweepInterval == 0 {
+		return fmt.Errorf("docker.sweep_grace requires docker.sweep_interval")
+	}
+	if config.Docker.MaxConcurrentStarts < 0 {
+		return fmt.Errorf("docker.max_concurrent_starts must not be negative")
+	}
+	for _, affix := range append(append([]string(nil), config.Docker.StripNamePrefixes...), config.Docker.StripNameSuffixes...) {
+		if affix == "" {
+			return fmt.Errorf("docker.strip_name_prefixes and docker.strip_name_suffixes must not contain empty strings")
+		}
+	}
+	for _, port := range config.Docker.FallbackPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("docker.fallback_ports: invalid port %d", port)
+		}
+	}
+	if config.Docker.LogoutOnStop && config.Docker.ReuseState {
+		return fmt.Errorf("docker.logout_on_stop and docker.reuse_state are mutually exclusive")
+	}
+	if config.Docker.IgnoreExisting && config.Docker.RequireInitialScan {
+		return fmt.Errorf("docker.ignore_existing and docker.require_initial_scan are mutually exclusive")
+	}
+	if _, err := path.Match(config.Docker.NetworkAliasPattern, ""); err != nil {
+		return fmt.Errorf("docker.network_alias_pattern %q is invalid: %w", config.Docker.NetworkAliasPattern, err)
+	}
 
 	for i, service := range config.Services {
-		if service.Target == "" {
+		if service.Target == "" && len(service.PathRoutes) == 0 && len(service.HeaderRoutes) == 0 && len(service.Listeners) == 0 {
 			return fmt.Errorf("service[%d]: target is required", i)
 		}
+		if service.Target != "" {
+			if _, err := parseTarget(service.Target); err != nil {
+				return fmt.Errorf("service[%d]: %w", i, err)
+			}
+		}
+		for prefix, target := range service.PathRoutes {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("service[%d]: path_routes prefix %q must start with /", i, prefix)
+			}
+			if _, err := parseTarget(target); err != nil {
+				return fmt.Errorf("service[%d]: path_routes[%s]: %w", i, prefix, err)
+			}
+		}
+		if service.LocalHealthPath != "" && !strings.HasPrefix(service.LocalHealthPath, "/") {
+			return fmt.Errorf("service[%d]: local_health_path %q must start with /", i, service.LocalHealthPath)
+		}
+		if service.WarmupPath != "" && !strings.HasPrefix(service.WarmupPath, "/") {
+			return fmt.Errorf("service[%d]: warmup_path %q must start with /", i, service.WarmupPath)
+		}
+		if service.RootRedirect != "" && (!strings.HasPrefix(service.RootRedirect, "/") || service.RootRedirect == "/") {
+			return fmt.Errorf("service[%d]: root_redirect %q must be a path other than /", i, service.RootRedirect)
+		}
+		for j, route := range service.HeaderRoutes {
+			if route.Header == "" {
+				return fmt.Errorf("service[%d]: header_routes[%d]: header is required", i, j)
+			}
+			if _, err := parseTarget(route.Target); err != nil {
+				return fmt.Errorf("service[%d]: header_routes[%d]: %w", i, j, err)
+			}
+		}
+		ports := map[int]bool{443: true}
+		for j, listener := range service.Listeners {
+			if listener.Port < 1 || listener.Port > 65535 {
+				return fmt.Errorf("service[%d]: listeners[%d]: invalid port %d", i, j, listener.Port)
+			}
+			if ports[listener.Port] {
+				return fmt.Errorf("service[%d]: listeners[%d]: port %d is already in use on this node", i, j, listener.Port)
+			}
+			ports[listener.Port] = true
+			if _, err := parseTarget(listener.Target); err != nil {
+				return fmt.Errorf("service[%d]: listeners[%d]: %w", i, j, err)
+			}
+		}
+		if _, err := newRewriteRules(service.RewriteRules); err != nil {
+			return fmt.Errorf("service[%d]: %w", i, err)
+		}
+		if service.FallbackTarget != "" {
+			if _, err := parseTarget(service.FallbackTarget); err != nil {
+				return fmt.Errorf("service[%d]: fallback_target: %w", i, err)
+			}
+		}
+		if service.CORS != nil && len(service.CORS.AllowedOrigins) == 0 {
+			return fmt.Errorf("service[%d]: cors.allowed_origins is required", i)
+		}
+		// Any website could otherwise make credentialed requests to the node
+		if service.CORS != nil && boolValue(service.CORS.AllowCredentials, false) && slices.Contains(service.CORS.AllowedOrigins, "*") {
+			return fmt.Errorf("service[%d]: cors.allow_credentials can't be used with the \"*\" origin", i)
+		}
+		if prefix := service.StatusPathPrefix; prefix != "" && (!strings.HasPrefix(prefix, "/") || prefix == "/") {
+			return fmt.Errorf("service[%d]: status_path_prefix must be an absolute path other than /", i)
+		}
+		if !redirectModes[service.RedirectMode] {
+			return fmt.Errorf("service[%d]: unknown redirect_mode %q (must be pass, follow or rewrite)", i, service.RedirectMode)
+		}
+		if service.MirrorTarget != "" {
+			if _, err := parseTarget(service.MirrorTarget); err != nil {
+				return fmt.Errorf("service[%d]: mirror_target: %w", i, err)
+			}
+		}
 		if service.NodeName == "" {
 			return fmt.Errorf("service[%d]: node_name is required", i)
 		}
+		if _, err := parseLogLevel(service.LogLevel); err != nil {
+			return fmt.Errorf("service[%d]: %w", i, err)
+		}
+		if service.LogMaxSize < 0 {
+			return fmt.Errorf("service[%d]: log_max_size must not be negative", i)
+		}
+		if intValue(service.LogMaxBackups, 0) < 0 {
+			return fmt.Errorf("service[%d]: log_max_backups must not be negative", i)
+		}
+		if (service.ClientCertFile == "") != (service.ClientKeyFile == "") {
+			return fmt.Errorf("service[%d]: client_cert_file and client_key_file must be set together", i)
+		}
+		for class, response := range service.ErrorResponses {
+			if !errorClasses[class] {
+				return fmt.Errorf("service[%d]: unknown error class %q in error_responses (must be dial, timeout or tls)", i, class)
+			}
+			if response.Status < 100 || response.Status > 599 {
+				return fmt.Errorf("service[%d]: error_responses[%s]: invalid status %d", i, class, response.Status)
+			}
+		}
+		if service.MaxConcurrentRequests < 0 {
+			return fmt.Errorf("service[%d]: max_concurrent_requests must not be negative", i)
+		}
+		if service.QueueTimeout != 0 && service.MaxConcurrentRequests == 0 {
+			return fmt.Errorf("service[%d]: queue_timeout requires max_concurrent_requests", i)
+		}
+		if service.ErrorRateThreshold < 0 || service.ErrorRateThreshold >= 1 {
+			return fmt.Errorf("service[%d]: error_rate_threshold must be between 0 and 1", i)
+		}
+		for _, code := range service.FailureStatusCodes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("service[%d]: failure_status_codes: invalid status code %d", i, code)
+			}
+		}
+		if len(service.FailureStatusCodes) > 0 && service.ErrorRateThreshold == 0 {
+			return fmt.Errorf("service[%d]: failure_status_codes requires error_rate_threshold", i)
+		}
+		if intValue(service.StartRetries, 0) < 0 {
+			return fmt.Errorf("service[%d]: start_retries must not be negative", i)
+		}
+		if fraction := floatValue(service.JitterFraction, 0); fraction < 0 || fraction >= 1 {
+			return fmt.Errorf("service[%d]: jitter_fraction must be at least 0 and less than 1", i)
+		}
+		if service.FirstRequestRetries < 0 || service.FirstRequestRetries > maxFirstRequestRetries {
+			return fmt.Errorf("service[%d]: first_request_retries must be between 0 and %d", i, maxFirstRequestRetries)
+		}
+		if service.RetryBudget < 0 || service.RetryBudget > 1 {
+			return fmt.Errorf("service[%d]: retry_budget must be between 0 and 1", i)
+		}
+		if service.ResponseBufferSize < 0 || service.ResponseBufferSize > maxResponseBufferSize {
+			return fmt.Errorf("service[%d]: response_buffer_size must be between 0 and %d bytes", i, maxResponseBufferSize)
+		}
+		if err := validateControlURL(service.ControlURL); err != nil {
+			return fmt.Errorf("service[%d]: %w", i, err)
+		}
+		// Keys minted through the Tailscale API are useless to other control servers
+		if service.ControlURL != "" && config.Tailscale.usesOAuth() {
+			return fmt.Errorf("service[%d]: control_url is not supported with tailscale oauth_client_id", i)
+		}
+		if service.SourceAddr != "" && net.ParseIP(service.SourceAddr) == nil {
+			return fmt.Errorf("service[%d]: source_addr %q is not a valid IP address", i, service.SourceAddr)
+		}
+		if service.HTTPProxy != "" {
+			u, err := url.Parse(service.HTTPProxy)
+			if err != nil || !supportedSchemes[u.Scheme] || u.Host == "" {
+				return fmt.Errorf("service[%d]: http_proxy must be an absolute http or https URL", i)
+			}
+			if service.SOCKS5Proxy != "" {
+				return fmt.Errorf("service[%d]: http_proxy and socks5_proxy are mutually exclusive", i)
+			}
+		}
+		if service.SOCKS5Proxy != "" {
+			u, err := url.Parse(service.SOCKS5Proxy)
+			if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+				return fmt.Errorf("service[%d]: socks5_proxy must be a socks5:// or socks5h:// URL", i)
+			}
+		}
+		if service.HTTPProxy == "" && service.SOCKS5Proxy == "" && len(service.NoProxy) > 0 {
+			return fmt.Errorf("service[%d]: no_proxy requires http_proxy or socks5_proxy", i)
+		}
+		for _, entry := range service.NoProxy {
+			if strings.Contains(entry, "/") {
+				if _, _, err := net.ParseCIDR(entry); err != nil {
+					return fmt.Errorf("service[%d]: no_proxy entry %q is not a valid CIDR", i, entry)
+				}
+			} else if strings.TrimPrefix(entry, ".") == "" {
+				return fmt.Errorf("service[%d]: no_proxy entries must not be empty", i)
+			}
+		}
 	}
 
 	return nil
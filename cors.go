@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMethods are allowed in preflight responses when cors.allowed_methods is unset
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for a request's
+// Origin, or an empty string if the origin is not allowed
+func corsAllowedOrigin(cors *CORSConfig, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == origin {
+			return origin
+		}
+		// Config validation rejects the wildcard together with allow_credentials
+		if allowed == "*" {
+			return "*"
+		}
+	}
+	return ""
+}
+
+// corsAnyOrigin reports whether allowed_origins is exactly ["*"], so responses
+// are the same for every origin
+func corsAnyOrigin(cors *CORSConfig) bool {
+	return len(cors.AllowedOrigins) == 1 && cors.AllowedOrigins[0] == "*"
+}
+
+// setCORSHeaders adds the headers allowing the request's origin to read the response
+func setCORSHeaders(header http.Header, cors *CORSConfig, origin string) bool {
+	// Responses differ by origin, including for origins that aren't allowed, so
+	// caches must not serve one origin's response to another
+	if !corsAnyOrigin(cors) {
+		header.Add("Vary", "Origin")
+	}
+
+	allowOrigin := corsAllowedOrigin(cors, origin)
+	if allowOrigin == "" {
+		return false
+	}
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+	if boolValue(cors.AllowCredentials, false) {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// handlePreflight answers a CORS preflight request and reports whether it was one
+func (p *Proxy) handlePreflight(w http.ResponseWriter, r *http.Request) bool {
+	cors := p.config.CORS
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	if !setCORSHeaders(w.Header(), cors, r.Header.Get("Origin")) {
+		p.logf(levelDebug, "%s: rejected CORS preflight from origin %q", p.config.NodeName, r.Header.Get("Origin"))
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+
+	methods := cors.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	// Without an explicit list, allow whatever headers the browser asks for
+	if len(cors.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requested)
+	}
+	if maxAge := time.Duration(cors.MaxAge); maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
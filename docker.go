@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"net"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/system"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 )
@@ -23,16 +32,116 @@ const (
 	labelNodeName           = "webtail.node_name"
 	labelPassHostHeader     = "webtail.pass_host_header"
 	labelTrustForwardHeader = "webtail.trust_forward_header"
+	labelNoCache            = "webtail.no_cache"
+	labelLogLevel           = "webtail.log_level"
+	labelHost               = "webtail.host"
+	labelNetwork            = "webtail.network"
+
+	// defaultLabelPrefix is the namespace of the label constants above
+	defaultLabelPrefix = "webtail"
+
+	// labelMetaPrefix prefixes labels copied into the proxy's metadata, e.g. webtail.meta.team
+	labelMetaPrefix = "webtail.meta."
+
+	// swarmNodeIDLabel is set by Swarm on task containers to the node they run on
+	swarmNodeIDLabel = "com.docker.swarm.node.id"
 
 	defaultProtocol = "http"
+
+	// defaultPublishedHost is where ports published on all interfaces are reached
+	defaultPublishedHost = "localhost"
+
+	// startSettleDelay is how long a container must stay running before a proxy is created
+	startSettleDelay = 2 * time.Second
+
+	// A container started crashLoopThreshold times within crashLoopWindow is
+	// considered crash-looping and is ignored for crashLoopBackoff
+	crashLoopWindow    = time.Minute
+	crashLoopThreshold = 3
+	crashLoopBackoff   = 5 * time.Minute
+
+	// initialScanRetries and initialScanBackoff control retries of the
+	// initial container scan when docker.require_initial_scan is set
+	initialScanRetries = 3
+	initialScanBackoff = time.Second
+
+	// defaultEventWorkers is how many container events are handled concurrently
+	defaultEventWorkers = 4
+
+	// eventQueueSize is how many events each worker queues before the event
+	// stream is paused
+	eventQueueSize = 256
+
+	// dockerPingTimeout bounds the reachability check of the Docker daemon at startup
+	dockerPingTimeout = 10 * time.Second
+
+	// eventsReconnectDelay is how long to wait before resubscribing to a closed event stream
+	eventsReconnectDelay = time.Second
+
+	// defaultMaxConcurrentStarts bounds concurrent proxy startups, e.g. after a host reboot
+	defaultMaxConcurrentStarts = 8
 )
 
+// errDockerUnreachable is returned by Start when the Docker daemon doesn't respond
+var errDockerUnreachable = errors.New("docker daemon is unreachable")
+
+// errInitialScanFailed is returned by Start when require_initial_scan is set
+// and existing containers couldn't be listed
+var errInitialScanFailed = errors.New("initial container scan failed")
+
+// triggerEventNames lists the container events that can trigger proxy creation
+var triggerEventNames = map[string]bool{
+	string(events.ActionCreate):  true,
+	string(events.ActionStart):   true,
+	string(events.ActionRestart): true,
+	string(events.ActionUnPause): true,
+}
+
+// discoveryStates lists the container states that include_states can select
+var discoveryStates = map[string]bool{
+	container.StateCreated:    true,
+	container.StateRunning:    true,
+	container.StatePaused:     true,
+	container.StateRestarting: true,
+}
+
+// defaultTriggerEvents are the events that trigger proxy creation unless configured
+var defaultTriggerEvents = []string{string(events.ActionStart)}
+
+// tlsPorts lists well-known ports assumed to serve HTTPS when inferring the protocol
+var tlsPorts = map[string]bool{
+	"443":  true,
+	"8443": true,
+}
+
+// dockerClient is the part of the Docker client the watcher uses, so discovery
+// can be tested against a fake daemon
+type dockerClient interface {
+	containerLister
+	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+	Info(ctx context.Context) (system.Info, error)
+	Ping(ctx context.Context) (types.Ping, error)
+	NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error)
+	DaemonHost() string
+	Close() error
+}
+
 // DockerWatcher watches for Docker container events and manages proxies
 type DockerWatcher struct {
-	client        *client.Client
+	client        dockerClient
 	tsConfig      *TailscaleConfig
+	config        *DockerConfig
+	defaults      *DefaultsConfig
 	dockerNetwork string
+	nodeID        string            // local Swarm node ID, set with local_node_only
 	proxies       map[string]*Proxy // containerID -> Proxy
+	pending       map[string]bool   // containerIDs with a proxy being started
+	starts        map[string][]time.Time
+	backoff       map[string]bool
+	unhealthy     map[string]time.Time // containerID -> first sweep that found its proxy unhealthy
+	stopWatches   map[string]context.CancelFunc
+	startSlots    startLimiter // bounds concurrent proxy start attempts
+	eventQueues   []chan events.Message
 	mu            sync.Mutex
 	ctx           context.Context
 	cancel        context.CancelFunc
@@ -40,7 +149,7 @@ type DockerWatcher struct {
 }
 
 // NewDockerWatcher creates a new Docker event watcher
-func NewDockerWatcher(tsConfig *TailscaleConfig, dockerConfig *DockerConfig) (*DockerWatcher, error) {
+func NewDockerWatcher(tsConfig *TailscaleConfig, dockerConfig *DockerConfig, defaults *DefaultsConfig) (*DockerWatcher, error) {
 	// Build client options - start with config values, then let environment variables override
 	var opts []client.Opt
 
@@ -72,31 +181,107 @@ func NewDockerWatcher(tsConfig *TailscaleConfig, dockerConfig *DockerConfig) (*D
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	maxStarts := dockerConfig.MaxConcurrentStarts
+	if maxStarts == 0 {
+		maxStarts = defaultMaxConcurrentStarts
+	}
+
+	// Ephemeral nodes are removed from the tailnet when their proxy stops, so
+	// reusing state across container recreations requires persistent nodes
+	if dockerConfig.ReuseState && tsConfig.Ephemeral {
+		persistent := *tsConfig
+		persistent.Ephemeral = false
+		tsConfig = &persistent
+	}
+
+	workers := dockerConfig.EventWorkers
+	if workers == 0 {
+		workers = defaultEventWorkers
+	}
+	eventQueues := make([]chan events.Message, workers)
+	for i := range eventQueues {
+		eventQueues[i] = make(chan events.Message, eventQueueSize)
+	}
+
 	return &DockerWatcher{
 		client:        cli,
 		tsConfig:      tsConfig,
+		config:        dockerConfig,
+		defaults:      defaults,
 		dockerNetwork: dockerConfig.Network,
 		proxies:       make(map[string]*Proxy),
+		pending:       make(map[string]bool),
+		starts:        make(map[string][]time.Time),
+		backoff:       make(map[string]bool),
+		unhealthy:     make(map[string]time.Time),
+		stopWatches:   make(map[string]context.CancelFunc),
+		startSlots:    make(startLimiter, maxStarts),
+		eventQueues:   eventQueues,
 		ctx:           ctx,
 		cancel:        cancel,
 	}, nil
 }
 
-// Start begins watching for Docker events
+// Start begins watching for Docker events. If it fails, the watcher is stopped
+// so its context and Docker client are released.
 func (dw *DockerWatcher) Start() error {
+	if err := dw.start(); err != nil {
+		dw.Stop()
+		return err
+	}
+	return nil
+}
+
+// start checks the daemon, scans existing containers and starts the event loop
+func (dw *DockerWatcher) start() error {
+	// Fail fast rather than silently discovering nothing
+	if err := dw.ping(); err != nil {
+		return err
+	}
+
+	// Targets are only resolvable on the configured network, so check it exists
+	if !dw.config.UsePublishedPorts {
+		if err := dw.checkNetwork(); err != nil {
+			if dw.config.RequireNetwork {
+				return err
+			}
+			log.Printf("ERROR: %v; proxies for discovered containers will not be able to reach them", err)
+		}
+	}
+
+	if dw.config.LocalNodeOnly {
+		info, err := dw.client.Info(dw.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get Docker node identity: %w", err)
+		}
+		dw.nodeID = info.Swarm.NodeID
+		if dw.nodeID == "" {
+			log.Printf("Warning: docker.local_node_only is set but this Docker host is not part of a swarm")
+		}
+	}
+
 	// First, scan existing containers
-	if err := dw.scanExistingContainers(); err != nil {
-		log.Printf("Warning: failed to scan existing containers: %v", err)
+	if dw.config.IgnoreExisting {
+		log.Println("Ignoring existing containers, only containers started from now on get a proxy")
+	} else if err := dw.scanExistingContainers(); err != nil {
+		if !dw.config.RequireInitialScan {
+			log.Printf("Warning: failed to scan existing containers: %v", err)
+		} else if err := dw.retryInitialScan(err); err != nil {
+			return err
+		}
 	}
 
-	// Set up event filters for container start events
+	// Set up event filters for the events that trigger proxy creation
 	filterArgs := filters.NewArgs()
 	filterArgs.Add("type", "container")
-	filterArgs.Add("event", "start")
+	for _, trigger := range dw.triggerEvents() {
+		filterArgs.Add("event", trigger)
+	}
+	if dw.config.WaitForHealthy {
+		filterArgs.Add("event", string(events.ActionHealthStatus))
+	}
 
-	eventsChan, errChan := dw.client.Events(dw.ctx, events.ListOptions{
-		Filters: filterArgs,
-	})
+	dw.startEventWorkers()
 
 	dw.wg.Add(1)
 	go func() {
@@ -104,136 +289,612 @@ func (dw *DockerWatcher) Start() error {
 		log.Println("Docker watcher started, listening for container events...")
 
 		for {
+			eventsChan, errChan := dw.client.Events(dw.ctx, events.ListOptions{
+				Filters: filterArgs,
+			})
+			if !dw.processEvents(eventsChan, errChan) {
+				return
+			}
+
+			log.Printf("Docker events stream closed, reconnecting in %s", eventsReconnectDelay)
 			select {
 			case <-dw.ctx.Done():
-				log.Println("Docker watcher stopping...")
-				return
-			case err := <-errChan:
-				if err != nil && dw.ctx.Err() == nil {
-					log.Printf("Docker events error: %v", err)
-				}
 				return
-			case event := <-eventsChan:
-				dw.handleEvent(event)
+			case <-time.After(eventsReconnectDelay):
 			}
 		}
 	}()
 
+	if interval := time.Duration(dw.config.SweepInterval); interval > 0 {
+		dw.wg.Add(1)
+		go func() {
+			defer dw.wg.Done()
+			dw.sweepLoop(interval)
+		}()
+	}
+
+	return nil
+}
+
+// sweepLoop periodically removes proxies whose containers are gone
+func (dw *DockerWatcher) sweepLoop(interval time.Duration) {
+	everyJittered(dw.ctx, interval, floatValue(dw.defaults.JitterFraction, defaultJitterFraction), dw.sweep)
+}
+
+// sweep stops proxies that have been unhealthy for at least sweep_grace and
+// whose containers no longer exist, as a safety net for missed stop events
+func (dw *DockerWatcher) sweep(now time.Time) {
+	grace := durationValue(dw.config.SweepGrace, defaultSweepGrace)
+
+	dw.mu.Lock()
+	proxies := make(map[string]*Proxy, len(dw.proxies))
+	for containerID, proxy := range dw.proxies {
+		proxies[containerID] = proxy
+	}
+	dw.mu.Unlock()
+
+	for containerID, proxy := range proxies {
+		if !dw.markUnhealthy(containerID, !dw.proxyHealthy(proxy), now, grace) {
+			continue
+		}
+
+		// Stopped containers are left to their stop events; only missing ones are removed
+		_, err := dw.client.ContainerInspect(dw.ctx, containerID)
+		if err == nil {
+			continue
+		}
+		if !cerrdefs.IsNotFound(err) {
+			// Don't treat a Docker API outage as every container being gone
+			log.Printf("Failed to check container %s during sweep: %v", shortID(containerID), err)
+			continue
+		}
+
+		log.Printf("Container %s no longer exists and its proxy has been unhealthy for %s, removing it",
+			shortID(containerID), grace)
+		dw.stopProxy(containerID)
+	}
+}
+
+// proxyHealthy reports whether a proxy is running and its target accepts connections
+func (dw *DockerWatcher) proxyHealthy(proxy *Proxy) bool {
+	if !proxy.Status().healthy() {
+		return false
+	}
+	target, err := parseTarget(proxy.config.Target)
+	if err != nil {
+		return false
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: sweepProbeTimeout}
+	conn, err := dialer.DialContext(dw.ctx, "tcp", net.JoinHostPort(target.Hostname(), port))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// markUnhealthy records whether a sweep found a container's proxy unhealthy and
+// reports whether it has been unhealthy on every sweep for at least grace
+func (dw *DockerWatcher) markUnhealthy(containerID string, unhealthy bool, now time.Time, grace time.Duration) bool {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if !unhealthy {
+		delete(dw.unhealthy, containerID)
+		return false
+	}
+	since, ok := dw.unhealthy[containerID]
+	if !ok {
+		dw.unhealthy[containerID] = now
+		return false
+	}
+	return now.Sub(since) >= grace
+}
+
+// processEvents handles events until the watcher stops or the stream fails,
+// and reports whether the stream was closed and should be reconnected
+func (dw *DockerWatcher) processEvents(eventsChan <-chan events.Message, errChan <-chan error) bool {
+	for {
+		select {
+		case <-dw.ctx.Done():
+			log.Println("Docker watcher stopping...")
+			return false
+		case err, ok := <-errChan:
+			if !ok {
+				return true
+			}
+			if err != nil && dw.ctx.Err() == nil {
+				log.Printf("Docker events error: %v", err)
+			}
+			return false
+		case event, ok := <-eventsChan:
+			if !ok {
+				return true
+			}
+			dw.enqueueEvent(event)
+		}
+	}
+}
+
+// enqueueEvent hands an event to the worker for its container, waiting while
+// the worker's queue is full so events are never dropped
+func (dw *DockerWatcher) enqueueEvent(event events.Message) {
+	// Events for one container always go to the same worker, keeping them in order
+	hash := fnv.New32a()
+	hash.Write([]byte(event.Actor.ID))
+	queue := dw.eventQueues[hash.Sum32()%uint32(len(dw.eventQueues))]
+
+	select {
+	case queue <- event:
+	case <-dw.ctx.Done():
+	}
+}
+
+// startEventWorkers starts the workers handling queued events, sharing a
+// limit of event_rate events per second if configured
+func (dw *DockerWatcher) startEventWorkers() {
+	var limiter <-chan time.Time
+	if dw.config.EventRate > 0 {
+		ticker := time.NewTicker(eventRateInterval(dw.config.EventRate))
+		limiter = ticker.C
+		dw.wg.Add(1)
+		go func() {
+			defer dw.wg.Done()
+			<-dw.ctx.Done()
+			ticker.Stop()
+		}()
+	}
+
+	for _, queue := range dw.eventQueues {
+		dw.wg.Add(1)
+		go func(queue <-chan events.Message) {
+			defer dw.wg.Done()
+			for {
+				select {
+				case <-dw.ctx.Done():
+					return
+				case event := <-queue:
+					if limiter != nil {
+						select {
+						case <-dw.ctx.Done():
+							return
+						case <-limiter:
+						}
+					}
+					dw.handleEvent(event)
+				}
+			}
+		}(queue)
+	}
+}
+
+// eventRateInterval returns the interval between events handled at rate events
+// per second. Tickers need a positive interval, so rates above one event per
+// nanosecond are clamped to it.
+func eventRateInterval(rate float64) time.Duration {
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval < time.Nanosecond {
+		return time.Nanosecond
+	}
+	return interval
+}
+
+// ping checks that the Docker daemon responds
+func (dw *DockerWatcher) ping() error {
+	ctx, cancel := context.WithTimeout(dw.ctx, dockerPingTimeout)
+	defer cancel()
+
+	if _, err := dw.client.Ping(ctx); err != nil {
+		return fmt.Errorf("%w at %s: %w", errDockerUnreachable, dw.client.DaemonHost(), err)
+	}
 	return nil
 }
 
-// scanExistingContainers checks running containers for webtail labels
+// checkNetwork verifies that the configured Docker network exists
+func (dw *DockerWatcher) checkNetwork() error {
+	if _, err := dw.client.NetworkInspect(dw.ctx, dw.dockerNetwork, network.InspectOptions{}); err != nil {
+		return fmt.Errorf("docker network %q is not available: %w", dw.dockerNetwork, err)
+	}
+	return nil
+}
+
+// scanExistingContainers checks running containers for webtail labels. Only
+// failing to list them is an error; containers that can't be handled are logged.
 func (dw *DockerWatcher) scanExistingContainers() error {
-	containers, err := dw.client.ContainerList(dw.ctx, container.ListOptions{
-		All: false, // Only running containers
-	})
+	// Without include_states only running (including paused and restarting) containers are listed
+	options := container.ListOptions{All: len(dw.config.IncludeStates) > 0}
+	if options.All {
+		options.Filters = filters.NewArgs()
+		for _, state := range dw.config.IncludeStates {
+			options.Filters.Add("status", state)
+		}
+	}
+
+	containers, err := dw.client.ContainerList(dw.ctx, options)
 	if err != nil {
 		return fmt.Errorf("failed to list containers: %w", err)
 	}
 
 	for _, c := range containers {
-		if err := dw.handleContainer(c.ID); err != nil {
-			log.Printf("Error handling existing container %s: %v", c.ID[:12], err)
+		// Created containers aren't running yet, so there is nothing to settle
+		if err := dw.handleContainer(c.ID, c.State != container.StateCreated); err != nil {
+			log.Printf("Error handling existing container %s: %v", shortID(c.ID), err)
 		}
 	}
 
 	return nil
 }
 
+// retryInitialScan retries a failed initial scan with exponential backoff
+func (dw *DockerWatcher) retryInitialScan(err error) error {
+	backoff := initialScanBackoff
+	dedup := newLogDeduper(time.Duration(dw.defaults.LogDedupWindow))
+	defer func() {
+		if repeats := dedup.flush(); repeats > 0 {
+			log.Printf("Last container scan error repeated %d times", repeats)
+		}
+	}()
+
+	for attempt := 1; attempt <= initialScanRetries; attempt++ {
+		if ok, repeats := dedup.check(err.Error(), time.Now()); ok {
+			if repeats > 0 {
+				log.Printf("Last container scan error repeated %d times", repeats)
+			}
+			log.Printf("Failed to scan existing containers (attempt %d/%d): %v, retrying in %s",
+				attempt, initialScanRetries+1, err, backoff)
+		}
+
+		select {
+		case <-dw.ctx.Done():
+			return dw.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if err = dw.scanExistingContainers(); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %w", errInitialScanFailed, err)
+}
+
 // handleEvent processes a Docker event
 func (dw *DockerWatcher) handleEvent(event events.Message) {
 	if event.Type != events.ContainerEventType {
 		return
 	}
 
-	switch event.Action {
-	case "start":
-		if err := dw.handleContainer(event.Actor.ID); err != nil {
-			log.Printf("Error handling container %s: %v", event.Actor.ID[:12], err)
+	switch {
+	case event.Action == events.ActionHealthStatusHealthy:
+		if err := dw.handleContainer(event.Actor.ID, true); err != nil {
+			log.Printf("Error handling container %s: %v", shortID(event.Actor.ID), err)
+		}
+	case dw.isTriggerEvent(event.Action):
+		attributes := dw.normalizeLabels(event.Actor.Attributes)
+		if event.Action == events.ActionStart && parseBoolLabel(attributes[labelEnabled], false) &&
+			dw.recordStart(event.Actor.ID, time.Now()) {
+			return
+		}
+		// Created containers aren't running yet, so there is nothing to settle
+		if err := dw.handleContainer(event.Actor.ID, event.Action != events.ActionCreate); err != nil {
+			log.Printf("Error handling container %s: %v", shortID(event.Actor.ID), err)
 		}
 	}
 }
 
-// handleContainer inspects a container and starts a proxy if enabled
-func (dw *DockerWatcher) handleContainer(containerID string) error {
+// triggerEvents returns the container events that trigger proxy creation
+func (dw *DockerWatcher) triggerEvents() []string {
+	if len(dw.config.TriggerEvents) == 0 {
+		return defaultTriggerEvents
+	}
+	return dw.config.TriggerEvents
+}
+
+// normalizeLabels maps labels in the configured label_prefix namespace onto the
+// webtail. names used by the label constants, dropping webtail. labels that belong
+// to another tool
+func (dw *DockerWatcher) normalizeLabels(labels map[string]string) map[string]string {
+	prefix := dw.config.LabelPrefix
+	if prefix == "" || prefix == defaultLabelPrefix {
+		return labels
+	}
+
+	normalized := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if strings.HasPrefix(key, defaultLabelPrefix+".") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(key, prefix+"."); ok {
+			key = defaultLabelPrefix + "." + name
+		}
+		normalized[key] = value
+	}
+	return normalized
+}
+
+// stripNameAffixes removes the first matching strip_name_prefixes and
+// strip_name_suffixes entries from a container name
+func (dw *DockerWatcher) stripNameAffixes(name string) string {
+	for _, prefix := range dw.config.StripNamePrefixes {
+		if stripped, ok := strings.CutPrefix(name, prefix); ok {
+			name = stripped
+			break
+		}
+	}
+	for _, suffix := range dw.config.StripNameSuffixes {
+		if stripped, ok := strings.CutSuffix(name, suffix); ok {
+			name = stripped
+			break
+		}
+	}
+	return name
+}
+
+// nodeNameAllowed reports whether a container may use the node name
+func (dw *DockerWatcher) nodeNameAllowed(nodeName string) bool {
+	if len(dw.config.AllowedNodeNames) == 0 {
+		return true
+	}
+	for _, allowed := range dw.config.AllowedNodeNames {
+		if allowed == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// stateEligible reports whether a container in the given state may get a proxy
+func (dw *DockerWatcher) stateEligible(state *container.State) bool {
+	if len(dw.config.IncludeStates) == 0 || state == nil {
+		return true
+	}
+	for _, included := range dw.config.IncludeStates {
+		if state.Status == included {
+			return true
+		}
+	}
+	return false
+}
+
+// isTriggerEvent reports whether a container event action triggers proxy creation
+func (dw *DockerWatcher) isTriggerEvent(action events.Action) bool {
+	for _, trigger := range dw.triggerEvents() {
+		if string(action) == trigger {
+			return true
+		}
+	}
+	return false
+}
+
+// containerServiceConfig inspects a container and builds the service config for
+// its proxy from its labels, or returns nil if it shouldn't get one. Containers
+// that need a docker.fallback_ports port get a service without a target unless
+// probe is set and one of the ports accepts connections.
+func (dw *DockerWatcher) containerServiceConfig(containerID string, probe bool) (*ServiceConfig, error) {
 	// Inspect the container to get full labels and container name
 	inspect, err := dw.client.ContainerInspect(dw.ctx, containerID)
 	if err != nil {
-		return fmt.Errorf("failed to inspect container: %w", err)
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
 	}
 
-	labels := inspect.Config.Labels
+	labels := dw.normalizeLabels(inspect.Config.Labels)
 
 	// Check if webtail is enabled
 	enabledStr, hasEnabled := labels[labelEnabled]
 	if !hasEnabled || strings.ToLower(enabledStr) != "true" {
-		return nil // Not enabled, skip
+		return nil, nil // Not enabled, skip
+	}
+
+	if !dw.stateEligible(inspect.State) {
+		log.Printf("Container %s is %s, not in include_states, skipping", shortID(containerID), inspect.State.Status)
+		return nil, nil
+	}
+
+	// Skip containers scheduled on another host, whose targets aren't reachable from here
+	if reason := dw.remoteContainerReason(labels); reason != "" {
+		log.Printf("Container %s %s, skipping", shortID(containerID), reason)
+		return nil, nil
+	}
+
+	// Containers with a healthcheck are picked up by their health_status: healthy event
+	if dw.config.WaitForHealthy && inspect.State != nil && inspect.State.Health != nil &&
+		inspect.State.Health.Status != container.Healthy {
+		log.Printf("Container %s is %s, waiting for it to become healthy", shortID(containerID), inspect.State.Health.Status)
+		return nil, nil
 	}
 
 	// Get container name (remove leading slash)
 	containerName := strings.TrimPrefix(inspect.Name, "/")
 
+	// The webtail.network label overrides the network for containers on a different one
+	dockerNetwork := dw.dockerNetwork
+	if network := labels[labelNetwork]; network != "" && !dw.config.UsePublishedPorts {
+		if inspect.NetworkSettings == nil || inspect.NetworkSettings.Networks[network] == nil {
+			log.Printf("Container %s has webtail.network=%s but is not attached to that network, skipping", shortID(containerID), network)
+			return nil, nil
+		}
+		dockerNetwork = network
+	}
+
+	// Prefer a stable network alias (e.g. the compose service name) for the target host
+	targetHost := containerName
+	if dw.config.PreferNetworkAlias && inspect.NetworkSettings != nil {
+		if endpoint := inspect.NetworkSettings.Networks[dockerNetwork]; endpoint != nil {
+			if alias := selectNetworkAlias(endpoint.Aliases, containerID, dw.config.NetworkAliasPattern); alias != "" {
+				targetHost = alias
+				log.Printf("Container %s: using network alias %q as target host", shortID(containerID), alias)
+			}
+		}
+	}
+
 	// Get port from label or detect from exposed ports
 	port := labels[labelPort]
-	if port == "" {
+	var binding nat.PortBinding
+	if dw.config.UsePublishedPorts {
+		var ports nat.PortMap
+		if inspect.NetworkSettings != nil {
+			ports = inspect.NetworkSettings.Ports
+		}
+		var ok bool
+		port, binding, ok = selectPublishedPort(ports, port)
+		if !ok {
+			log.Printf("Container %s has webtail.enabled=true but no matching port published to the host", shortID(containerID))
+			return nil, nil
+		}
+	} else if port == "" {
 		// Auto-detect port from container's exposed ports (use lowest)
 		detectedPort := getLowestExposedPort(inspect.Config.ExposedPorts)
-		if detectedPort == "" {
-			log.Printf("Container %s has webtail.enabled=true but no webtail.port label and no exposed ports", containerID[:12])
-			return nil
+		if detectedPort != "" {
+			port = detectedPort
+			log.Printf("Container %s: auto-detected port %s (lowest exposed port)", shortID(containerID), port)
+		} else if len(dw.config.FallbackPorts) > 0 {
+			// Some images listen without declaring EXPOSE, so look for a port that answers
+			if probe {
+				port = probeFallbackPorts(dw.ctx, targetHost+"."+dockerNetwork, dw.config.FallbackPorts)
+			}
+			if port != "" {
+				log.Printf("Container %s: detected port %s (first listening fallback port)", shortID(containerID), port)
+			}
+		} else {
+			log.Printf("Container %s has webtail.enabled=true but no webtail.port label and no exposed ports", shortID(containerID))
+			return nil, nil
 		}
-		port = detectedPort
-		log.Printf("Container %s: auto-detected port %s (lowest exposed port)", containerID[:12], port)
 	}
 
 	// Get node name from label or default to container name
 	nodeName := labels[labelNodeName]
 	if nodeName == "" {
-		nodeName = containerName
-		log.Printf("Container %s: using container name %q as node name", containerID[:12], nodeName)
+		nodeName = dw.stripNameAffixes(containerName)
+		if nodeName == "" {
+			log.Printf("Container %s: container name %q is empty after stripping prefixes and suffixes, skipping", shortID(containerID), containerName)
+			return nil, nil
+		}
+		log.Printf("Container %s: using container name %q as node name %q", shortID(containerID), containerName, nodeName)
+	}
+
+	// Make sure the node name is a valid hostname
+	if sanitized := sanitizeHostname(nodeName); sanitized != nodeName {
+		if sanitized == "" {
+			log.Printf("Container %s: node name %q is not a valid hostname, skipping", shortID(containerID), nodeName)
+			return nil, nil
+		}
+		log.Printf("Container %s: node name %q is not a valid hostname, using %q", shortID(containerID), nodeName, sanitized)
+		nodeName = sanitized
+	}
+
+	// Only centrally approved hostnames may join the tailnet
+	if !dw.nodeNameAllowed(nodeName) {
+		log.Printf("Container %s: node name %q is not in allowed_node_names, skipping", shortID(containerID), nodeName)
+		return nil, nil
 	}
 
 	// Get optional labels with defaults
 	protocol := labels[labelProtocol]
 	if protocol == "" {
 		protocol = defaultProtocol
+		if dw.config.InferProtocolFromPort && tlsPorts[port] {
+			protocol = "https"
+			log.Printf("Container %s: inferred protocol %q from port %s", shortID(containerID), protocol, port)
+		}
 	}
-	passHostHeader := parseBoolLabel(labels[labelPassHostHeader], false)
-	trustForwardHeader := parseBoolLabel(labels[labelTrustForwardHeader], false)
-
-	// Build target URL dynamically: {protocol}://{container_name}.{docker_network}:{port}
-	target := fmt.Sprintf("%s://%s.%s:%s", protocol, containerName, dw.dockerNetwork, port)
+	passHostHeader := parseBoolLabel(labels[labelPassHostHeader], boolValue(dw.defaults.PassHostHeader, false))
+	trustForwardHeader := parseBoolLabel(labels[labelTrustForwardHeader], boolValue(dw.defaults.TrustForwardHeader, false))
+	noCache := parseBoolLabel(labels[labelNoCache], false)
 
-	// Check if we already have a proxy for this container
-	dw.mu.Lock()
-	if _, exists := dw.proxies[containerID]; exists {
-		dw.mu.Unlock()
-		log.Printf("Proxy already exists for container %s (%s)", containerID[:12], nodeName)
-		return nil
+	// Build target URL dynamically: {protocol}://{container_name}.{docker_network}:{port},
+	// or {protocol}://{host}:{published_port} for ports published to the host
+	var target string
+	if dw.config.UsePublishedPorts {
+		target = fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(publishedHost(binding, dw.config.PublishedHost), binding.HostPort))
+	} else if port != "" {
+		target = fmt.Sprintf("%s://%s.%s:%s", protocol, targetHost, dockerNetwork, port)
 	}
-	dw.mu.Unlock()
 
 	// Create service config from labels
-	serviceConfig := &ServiceConfig{
+	return &ServiceConfig{
 		Target:             target,
 		NodeName:           nodeName,
 		PassHostHeader:     &passHostHeader,
 		TrustForwardHeader: &trustForwardHeader,
+		NoCache:            &noCache,
+		LogLevel:           labels[labelLogLevel],
+		Labels:             metaLabels(labels),
+		StartRetries:       dw.defaults.StartRetries,
+		StartRetryBackoff:  dw.defaults.StartRetryBackoff,
+		LogDedupWindow:     dw.defaults.LogDedupWindow,
+		JitterFraction:     dw.defaults.JitterFraction,
+	}, nil
+}
+
+// handleContainer inspects a container and starts a proxy if enabled. With settle,
+// the proxy is only started if the container is still running after startSettleDelay.
+func (dw *DockerWatcher) handleContainer(containerID string, settle bool) error {
+	serviceConfig, err := dw.containerServiceConfig(containerID, false)
+	if err != nil || serviceConfig == nil {
+		return err
 	}
+	nodeName := serviceConfig.NodeName
 
-	log.Printf("Container %s started with webtail enabled: %s -> %s",
-		containerID[:12], nodeName, target)
+	if !dw.tsConfig.canJoin(nodeName) {
+		log.Printf("Container %s (%s): no tailscale auth_key configured and the node has no saved state, skipping",
+			shortID(containerID), nodeName)
+		return nil
+	}
 
-	// Create and start proxy
-	proxy := NewProxy(serviceConfig, dw.tsConfig)
+	// Check if we already have a proxy for this container
+	dw.mu.Lock()
+	if proxy, exists := dw.proxies[containerID]; exists || dw.pending[containerID] {
+		dw.mu.Unlock()
+		log.Printf("Proxy already exists for container %s (%s)", shortID(containerID), nodeName)
+		// A restarted container may have a new IP; don't reuse connections to the old one
+		if proxy != nil {
+			proxy.CloseIdleConnections()
+		}
+		return nil
+	}
+	dw.pending[containerID] = true
+	dw.mu.Unlock()
 
 	dw.wg.Add(1)
 	go func() {
 		defer dw.wg.Done()
+		defer func() {
+			dw.mu.Lock()
+			delete(dw.pending, containerID)
+			dw.mu.Unlock()
+		}()
+
+		// Make sure the container is still up before bringing up a tailnet node
+		if settle && !dw.waitRunning(containerID) {
+			log.Printf("Container %s (%s) exited within %s of starting, skipping proxy creation",
+				shortID(containerID), nodeName, startSettleDelay)
+			return
+		}
+
+		// A container that just started may not be listening yet, so fallback
+		// ports are only probed once it has settled
+		if serviceConfig.Target == "" {
+			if serviceConfig = dw.resolveFallbackPort(containerID); serviceConfig == nil {
+				return
+			}
+		}
 
-		if err := proxy.Start(); err != nil {
+		log.Printf("Container %s started with webtail enabled: %s -> %s",
+			shortID(containerID), nodeName, serviceConfig.Target)
+
+		// Create and start proxy
+		proxy := NewProxy(serviceConfig, dw.tsConfig)
+		if err := dw.startProxy(proxy); err != nil {
 			log.Printf("Failed to start proxy for container %s (%s): %v",
-				containerID[:12], nodeName, err)
+				shortID(containerID), nodeName, err)
 			return
 		}
 
@@ -241,7 +902,7 @@ func (dw *DockerWatcher) handleContainer(containerID string) error {
 		dw.proxies[containerID] = proxy
 		dw.mu.Unlock()
 
-		log.Printf("Started proxy for container %s (%s)", containerID[:12], nodeName)
+		log.Printf("Started proxy for container %s (%s)", shortID(containerID), nodeName)
 
 		// Watch for container stop/die events
 		dw.watchContainerStop(containerID, nodeName)
@@ -250,6 +911,129 @@ func (dw *DockerWatcher) handleContainer(containerID string) error {
 	return nil
 }
 
+// resolveFallbackPort probes a container's docker.fallback_ports, retrying a
+// few times while the container may still be starting to listen, and returns
+// its service config or nil if it shouldn't get a proxy
+func (dw *DockerWatcher) resolveFallbackPort(containerID string) *ServiceConfig {
+	for attempt := 1; ; attempt++ {
+		serviceConfig, err := dw.containerServiceConfig(containerID, true)
+		if err != nil {
+			log.Printf("Error handling container %s: %v", shortID(containerID), err)
+			return nil
+		}
+		if serviceConfig == nil || serviceConfig.Target != "" {
+			return serviceConfig
+		}
+		if attempt == fallbackPortProbeAttempts {
+			log.Printf("Container %s has webtail.enabled=true but no exposed ports and none of fallback_ports accepts connections after %d attempts",
+				shortID(containerID), attempt)
+			return nil
+		}
+
+		select {
+		case <-dw.ctx.Done():
+			return nil
+		case <-time.After(fallbackPortProbeInterval):
+		}
+	}
+}
+
+// remoteContainerReason explains why a container belongs to another host,
+// or returns an empty string if it should be proxied from this one
+func (dw *DockerWatcher) remoteContainerReason(labels map[string]string) string {
+	if nodeID, ok := labels[swarmNodeIDLabel]; ok && dw.nodeID != "" && nodeID != dw.nodeID {
+		return fmt.Sprintf("runs on swarm node %s", nodeID)
+	}
+	if host, ok := labels[labelHost]; ok && dw.config.HostID != "" && host != dw.config.HostID {
+		return fmt.Sprintf("is assigned to webtail host %q", host)
+	}
+	return ""
+}
+
+// startProxy starts a proxy, holding one of the limited startup slots during
+// each start attempt but not while waiting to retry
+func (dw *DockerWatcher) startProxy(proxy *Proxy) error {
+	proxy.SetStartLimiter(dw.startSlots)
+
+	// Stopping the watcher abandons a node that is still waiting to come up
+	stop := context.AfterFunc(dw.ctx, proxy.cancel)
+	defer stop()
+
+	return proxy.Start()
+}
+
+// waitRunning waits for the settle delay and reports whether the container is still running
+func (dw *DockerWatcher) waitRunning(containerID string) bool {
+	select {
+	case <-dw.ctx.Done():
+		return false
+	case <-time.After(startSettleDelay):
+	}
+
+	inspect, err := dw.client.ContainerInspect(dw.ctx, containerID)
+	if err != nil {
+		return false
+	}
+	return inspect.State != nil && inspect.State.Running
+}
+
+// recordStart tracks a container start at now and reports whether the container is
+// crash-looping. Crash-looping containers are ignored until the backoff expires,
+// then rechecked once.
+func (dw *DockerWatcher) recordStart(containerID string, now time.Time) bool {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if dw.backoff[containerID] {
+		return true
+	}
+
+	// Forget containers that haven't started within the window, e.g. removed ones
+	for id, starts := range dw.starts {
+		if now.Sub(starts[len(starts)-1]) >= crashLoopWindow {
+			delete(dw.starts, id)
+		}
+	}
+
+	var recent []time.Time
+	for _, t := range dw.starts[containerID] {
+		if now.Sub(t) < crashLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < crashLoopThreshold {
+		dw.starts[containerID] = recent
+		return false
+	}
+
+	log.Printf("Container %s is crash-looping (%d starts within %s), backing off for %s",
+		shortID(containerID), len(recent), crashLoopWindow, crashLoopBackoff)
+	delete(dw.starts, containerID)
+	dw.backoff[containerID] = true
+
+	dw.wg.Add(1)
+	go func() {
+		defer dw.wg.Done()
+		select {
+		case <-dw.ctx.Done():
+			return
+		case <-time.After(crashLoopBackoff):
+		}
+
+		dw.mu.Lock()
+		delete(dw.backoff, containerID)
+		dw.mu.Unlock()
+
+		if err := dw.handleContainer(containerID, true); err != nil {
+			log.Printf("Error rechecking container %s after crash-loop backoff: %v", shortID(containerID), err)
+		}
+	}()
+
+	return true
+}
+
 // watchContainerStop monitors for when a container stops
 func (dw *DockerWatcher) watchContainerStop(containerID, nodeName string) {
 	filterArgs := filters.NewArgs()
@@ -259,25 +1043,48 @@ func (dw *DockerWatcher) watchContainerStop(containerID, nodeName string) {
 	filterArgs.Add("event", "die")
 	filterArgs.Add("event", "kill")
 
-	eventsChan, errChan := dw.client.Events(dw.ctx, events.ListOptions{
+	// stopProxy cancels the watch if the proxy is removed some other way
+	ctx, cancel := context.WithCancel(dw.ctx)
+	defer cancel()
+	dw.mu.Lock()
+	dw.stopWatches[containerID] = cancel
+	dw.mu.Unlock()
+	defer func() {
+		dw.mu.Lock()
+		delete(dw.stopWatches, containerID)
+		dw.mu.Unlock()
+	}()
+
+	eventsChan, errChan := dw.client.Events(ctx, events.ListOptions{
 		Filters: filterArgs,
 	})
 
+	if dw.waitForStop(ctx, containerID, eventsChan, errChan) {
+		log.Printf("Container %s (%s) stopped, shutting down proxy",
+			shortID(containerID), nodeName)
+		dw.stopProxy(containerID)
+	}
+}
+
+// waitForStop waits for a stop event for the container and reports whether
+// one arrived, as opposed to the watcher stopping or the stream ending
+func (dw *DockerWatcher) waitForStop(ctx context.Context, containerID string, eventsChan <-chan events.Message, errChan <-chan error) bool {
 	for {
 		select {
-		case <-dw.ctx.Done():
-			return
-		case err := <-errChan:
-			if err != nil && dw.ctx.Err() == nil {
-				log.Printf("Error watching container %s: %v", containerID[:12], err)
+		case <-ctx.Done():
+			return false
+		case err, ok := <-errChan:
+			if ok && err != nil && ctx.Err() == nil {
+				log.Printf("Error watching container %s: %v", shortID(containerID), err)
+			}
+			return false
+		case event, ok := <-eventsChan:
+			if !ok {
+				log.Printf("Event stream for container %s closed, no longer watching it", shortID(containerID))
+				return false
 			}
-			return
-		case event := <-eventsChan:
 			if event.Action == "stop" || event.Action == "die" || event.Action == "kill" {
-				log.Printf("Container %s (%s) stopped, shutting down proxy",
-					containerID[:12], nodeName)
-				dw.stopProxy(containerID)
-				return
+				return true
 			}
 		}
 	}
@@ -290,15 +1097,26 @@ func (dw *DockerWatcher) stopProxy(containerID string) {
 	if exists {
 		delete(dw.proxies, containerID)
 	}
+	delete(dw.unhealthy, containerID)
+	if cancel, ok := dw.stopWatches[containerID]; ok {
+		cancel()
+	}
 	dw.mu.Unlock()
 
 	if exists && proxy != nil {
 		if err := proxy.Stop(); err != nil {
-			log.Printf("Error stopping proxy for container %s: %v", containerID[:12], err)
+			log.Printf("Error stopping proxy for container %s: %v", shortID(containerID), err)
 		}
 	}
 }
 
+// Drain puts all managed proxies into draining mode
+func (dw *DockerWatcher) Drain() {
+	for _, proxy := range dw.GetProxies() {
+		proxy.Drain()
+	}
+}
+
 // Stop gracefully shuts down the Docker watcher and all managed proxies
 func (dw *DockerWatcher) Stop() error {
 	dw.cancel()
@@ -317,6 +1135,9 @@ func (dw *DockerWatcher) Stop() error {
 		stopWg.Add(1)
 		go func(p *Proxy) {
 			defer stopWg.Done()
+			if dw.config.LogoutOnStop {
+				p.Logout()
+			}
 			if err := p.Stop(); err != nil {
 				log.Printf("Error stopping proxy: %v", err)
 			}
@@ -345,6 +1166,22 @@ func (dw *DockerWatcher) GetProxies() []*Proxy {
 	return proxies
 }
 
+// metaLabels returns the webtail.meta.* container labels with the prefix removed
+func metaLabels(labels map[string]string) map[string]string {
+	var meta map[string]string
+	for key, value := range labels {
+		name, ok := strings.CutPrefix(key, labelMetaPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[name] = value
+	}
+	return meta
+}
+
 // parseBoolLabel parses a string label as boolean with a default value
 func parseBoolLabel(value string, defaultVal bool) bool {
 	if value == "" {
@@ -381,3 +1218,106 @@ func getLowestExposedPort(exposedPorts nat.PortSet) string {
 	return strconv.Itoa(ports[0])
 }
 
+// probeFallbackPorts returns the first of ports accepting TCP connections on
+// host, or an empty string if none does
+func probeFallbackPorts(ctx context.Context, host string, ports []int) string {
+	dialer := &net.Dialer{Timeout: fallbackPortProbeTimeout}
+	for _, port := range ports {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return strconv.Itoa(port)
+	}
+	return ""
+}
+
+// selectNetworkAlias returns the first alias, in sorted order, that is a valid
+// hostname, isn't derived from the container ID and matches the optional pattern.
+// It returns an empty string if no alias is suitable.
+func selectNetworkAlias(aliases []string, containerID, pattern string) string {
+	sorted := append([]string(nil), aliases...)
+	sort.Strings(sorted)
+
+	for _, alias := range sorted {
+		// Docker adds the short container ID as an alias, which changes on recreate
+		if strings.HasPrefix(containerID, alias) || sanitizeHostname(alias) != alias {
+			continue
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, alias); !ok {
+				continue
+			}
+		}
+		return alias
+	}
+	return ""
+}
+
+// selectPublishedPort returns the container port and its host binding for
+// the given container port, or for the lowest published TCP port if empty
+func selectPublishedPort(ports nat.PortMap, containerPort string) (string, nat.PortBinding, bool) {
+	var candidates []nat.Port
+	for port, bindings := range ports {
+		if port.Proto() != "tcp" || len(bindings) == 0 {
+			continue
+		}
+		if containerPort == "" || port.Port() == containerPort {
+			candidates = append(candidates, port)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Int() < candidates[j].Int()
+	})
+
+	for _, port := range candidates {
+		for _, binding := range ports[port] {
+			if binding.HostPort != "" {
+				return port.Port(), binding, true
+			}
+		}
+	}
+	return "", nat.PortBinding{}, false
+}
+
+// publishedHost returns the address to reach a published port on, using
+// defaultHost for ports published on all interfaces
+func publishedHost(binding nat.PortBinding, defaultHost string) string {
+	if ip := net.ParseIP(binding.HostIP); ip != nil && !ip.IsUnspecified() {
+		return binding.HostIP
+	}
+	if defaultHost == "" {
+		return defaultPublishedHost
+	}
+	return defaultHost
+}
+
+// shortID returns the abbreviated form of a container ID for logging
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// sanitizeHostname converts a name into a valid hostname label: lowercase
+// letters, digits and hyphens, at most 63 characters, not starting or ending
+// with a hyphen. It returns an empty string if nothing usable remains.
+func sanitizeHostname(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+
+	hostname := b.String()
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	return strings.Trim(hostname, "-")
+}
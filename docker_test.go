@@ -0,0 +1,799 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestShortID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "4f66ad9a0b2e7c1d3e5f6a7b8c9d0e1f", want: "4f66ad9a0b2e"},
+		{id: "4f66ad9a0b2e", want: "4f66ad9a0b2e"},
+		{id: "4f66", want: "4f66"},
+		{id: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := shortID(tt.id); got != tt.want {
+			t.Errorf("shortID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "plex", want: "plex"},
+		{name: "My_App", want: "my-app"},
+		{name: "stack_web.1", want: "stack-web-1"},
+		{name: "-leading-and-trailing-", want: "leading-and-trailing"},
+		{name: "___", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeHostname(tt.name); got != tt.want {
+			t.Errorf("sanitizeHostname(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectNetworkAlias(t *testing.T) {
+	const containerID = "4f66ad9a0b2e7c1d3e5f6a7b8c9d0e1f"
+
+	tests := []struct {
+		name    string
+		aliases []string
+		pattern string
+		want    string
+	}{
+		{name: "compose service alias", aliases: []string{"4f66ad9a0b2e", "web"}, want: "web"},
+		{name: "sorted order", aliases: []string{"web", "api"}, want: "api"},
+		{name: "pattern match", aliases: []string{"api", "web-frontend"}, pattern: "web-*", want: "web-frontend"},
+		{name: "no pattern match", aliases: []string{"api"}, pattern: "web-*", want: ""},
+		{name: "only container ID", aliases: []string{"4f66ad9a0b2e"}, want: ""},
+		{name: "invalid hostname", aliases: []string{"My_App"}, want: ""},
+		{name: "no aliases", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := selectNetworkAlias(tt.aliases, containerID, tt.pattern); got != tt.want {
+			t.Errorf("%s: selectNetworkAlias(%q, %q) = %q, want %q", tt.name, tt.aliases, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteContainerReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodeID     string
+		hostID     string
+		labels     map[string]string
+		wantRemote bool
+	}{
+		{name: "no filters", labels: map[string]string{swarmNodeIDLabel: "node-b", labelHost: "nas"}},
+		{name: "same swarm node", nodeID: "node-a", labels: map[string]string{swarmNodeIDLabel: "node-a"}},
+		{name: "other swarm node", nodeID: "node-a", labels: map[string]string{swarmNodeIDLabel: "node-b"}, wantRemote: true},
+		{name: "not a swarm task", nodeID: "node-a", labels: map[string]string{}},
+		{name: "same host", hostID: "nas", labels: map[string]string{labelHost: "nas"}},
+		{name: "other host", hostID: "nas", labels: map[string]string{labelHost: "pi"}, wantRemote: true},
+		{name: "unpinned container", hostID: "nas", labels: map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		dw := &DockerWatcher{config: &DockerConfig{HostID: tt.hostID}, nodeID: tt.nodeID}
+		if got := dw.remoteContainerReason(tt.labels); (got != "") != tt.wantRemote {
+			t.Errorf("%s: remoteContainerReason() = %q, want remote %v", tt.name, got, tt.wantRemote)
+		}
+	}
+}
+
+// newTestWatcher creates a DockerWatcher without a Docker client for exercising event handling
+func newTestWatcher(t *testing.T) *DockerWatcher {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &DockerWatcher{config: &DockerConfig{}, ctx: ctx, cancel: cancel}
+}
+
+func TestProcessEventsClosedStream(t *testing.T) {
+	dw := newTestWatcher(t)
+
+	eventsChan := make(chan events.Message)
+	close(eventsChan)
+
+	done := make(chan bool, 1)
+	go func() { done <- dw.processEvents(eventsChan, make(chan error)) }()
+
+	select {
+	case reconnect := <-done:
+		if !reconnect {
+			t.Error("processEvents() = false, want true to reconnect after the stream closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("processEvents() did not return after the events channel closed")
+	}
+}
+
+func TestProcessEventsStopped(t *testing.T) {
+	dw := newTestWatcher(t)
+	dw.cancel()
+
+	if dw.processEvents(make(chan events.Message), make(chan error)) {
+		t.Error("processEvents() = true, want false once the watcher is stopped")
+	}
+}
+
+func TestWaitForStop(t *testing.T) {
+	const containerID = "4f66ad9a0b2e7c1d3e5f6a7b8c9d0e1f"
+
+	t.Run("stop event", func(t *testing.T) {
+		dw := newTestWatcher(t)
+		eventsChan := make(chan events.Message, 2)
+		eventsChan <- events.Message{Action: events.ActionRestart}
+		eventsChan <- events.Message{Action: events.ActionDie}
+
+		if !dw.waitForStop(dw.ctx, containerID, eventsChan, make(chan error)) {
+			t.Error("waitForStop() = false, want true after a die event")
+		}
+	})
+
+	t.Run("closed stream", func(t *testing.T) {
+		dw := newTestWatcher(t)
+		eventsChan := make(chan events.Message)
+		close(eventsChan)
+
+		done := make(chan bool, 1)
+		go func() { done <- dw.waitForStop(dw.ctx, containerID, eventsChan, make(chan error)) }()
+
+		select {
+		case stopped := <-done:
+			if stopped {
+				t.Error("waitForStop() = true, want false when the stream closed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waitForStop() did not return after the events channel closed")
+		}
+	})
+}
+
+func TestSelectPublishedPort(t *testing.T) {
+	ports := nat.PortMap{
+		"80/tcp":   {{HostIP: "0.0.0.0", HostPort: "8080"}, {HostIP: "::", HostPort: "8080"}},
+		"443/tcp":  {{HostIP: "127.0.0.1", HostPort: "8443"}},
+		"53/udp":   {{HostIP: "0.0.0.0", HostPort: "5353"}},
+		"9000/tcp": nil,
+	}
+
+	tests := []struct {
+		name          string
+		containerPort string
+		wantPort      string
+		wantHost      string
+		wantOK        bool
+	}{
+		{name: "lowest published tcp port", wantPort: "80", wantHost: "localhost:8080", wantOK: true},
+		{name: "port from label", containerPort: "443", wantPort: "443", wantHost: "127.0.0.1:8443", wantOK: true},
+		{name: "exposed but not published", containerPort: "9000"},
+		{name: "udp only", containerPort: "53"},
+	}
+
+	for _, tt := range tests {
+		port, binding, ok := selectPublishedPort(ports, tt.containerPort)
+		if ok != tt.wantOK || port != tt.wantPort {
+			t.Errorf("%s: selectPublishedPort() = %q, %v, want %q, %v", tt.name, port, ok, tt.wantPort, tt.wantOK)
+			continue
+		}
+		if ok {
+			if got := net.JoinHostPort(publishedHost(binding, ""), binding.HostPort); got != tt.wantHost {
+				t.Errorf("%s: published address = %q, want %q", tt.name, got, tt.wantHost)
+			}
+		}
+	}
+}
+
+func TestMetaLabels(t *testing.T) {
+	labels := map[string]string{
+		labelEnabled:           "true",
+		"webtail.meta.team":    "media",
+		"webtail.meta.env":     "prod",
+		"webtail.meta.":        "ignored",
+		"com.example.whatever": "ignored",
+	}
+
+	got := metaLabels(labels)
+	want := map[string]string{"team": "media", "env": "prod"}
+	if len(got) != len(want) {
+		t.Fatalf("metaLabels() = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("metaLabels()[%q] = %q, want %q", key, got[key], value)
+		}
+	}
+
+	if got := metaLabels(map[string]string{labelEnabled: "true"}); got != nil {
+		t.Errorf("metaLabels() without meta labels = %v, want nil", got)
+	}
+}
+
+func TestMarkUnhealthy(t *testing.T) {
+	const containerID = "4f66ad9a0b2e7c1d3e5f6a7b8c9d0e1f"
+	dw := &DockerWatcher{unhealthy: make(map[string]time.Time)}
+
+	now := time.Now()
+	steps := []struct {
+		after      time.Duration
+		unhealthy  bool
+		wantRemove bool
+	}{
+		{unhealthy: true},                      // first failure starts the grace period
+		{after: time.Minute, unhealthy: false}, // recovered
+		{after: time.Minute, unhealthy: true},
+		{after: 4 * time.Minute, unhealthy: true},
+		{after: time.Minute, unhealthy: true, wantRemove: true}, // unhealthy for the whole grace period
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := dw.markUnhealthy(containerID, step.unhealthy, now, 5*time.Minute); got != step.wantRemove {
+			t.Errorf("sweep %d: markUnhealthy(unhealthy=%v) = %v, want %v", i, step.unhealthy, got, step.wantRemove)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer backend.Close()
+
+	dw := newTestWatcher(t)
+	dw.config = &DockerConfig{SweepGrace: Duration(time.Minute)}
+	dw.unhealthy = make(map[string]time.Time)
+	dw.stopWatches = make(map[string]context.CancelFunc)
+	dw.client = fakeDockerClient{fakeContainerLister{"stopped": newFakeContainer("worker", nil)}}
+
+	newProxy := func(target string, running bool) *Proxy {
+		p := NewProxy(&ServiceConfig{Target: target, NodeName: "app"}, &TailscaleConfig{})
+		if running {
+			p.setState(StateRunning, nil)
+		}
+		return p
+	}
+	dw.proxies = map[string]*Proxy{
+		// Unhealthy and no longer known to Docker
+		"gone": newProxy("http://127.0.0.1:1", false),
+		// Unhealthy, but the container still exists
+		"stopped": newProxy("http://127.0.0.1:1", false),
+		// Unknown to Docker, but still serving
+		"healthy": newProxy("http://"+backend.Addr().String(), true),
+	}
+
+	now := time.Now()
+	dw.sweep(now)
+	dw.sweep(now.Add(30 * time.Second))
+	if len(dw.proxies) != 3 {
+		t.Fatalf("proxies after sweeps within the grace period = %d, want 3", len(dw.proxies))
+	}
+
+	dw.sweep(now.Add(time.Minute))
+	if _, ok := dw.proxies["gone"]; ok {
+		t.Error("proxy of a missing container unhealthy for the grace period was not removed")
+	}
+	for _, id := range []string{"stopped", "healthy"} {
+		if _, ok := dw.proxies[id]; !ok {
+			t.Errorf("proxy %q was removed, want it kept", id)
+		}
+	}
+}
+
+func TestRecordStart(t *testing.T) {
+	const containerID = "4f66ad9a0b2e7c1d3e5f6a7b8c9d0e1f"
+	dw := newTestWatcher(t)
+	dw.starts = make(map[string][]time.Time)
+	dw.backoff = make(map[string]bool)
+
+	now := time.Now()
+	steps := []struct {
+		after       time.Duration
+		wantBackoff bool
+	}{
+		{after: 0},
+		{after: 50 * time.Second},
+		{after: 20 * time.Second}, // the first start fell out of the window
+		{after: 10 * time.Second, wantBackoff: true},
+		{after: time.Second, wantBackoff: true}, // ignored while backing off
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := dw.recordStart(containerID, now); got != step.wantBackoff {
+			t.Errorf("start %d: recordStart() = %v, want %v", i, got, step.wantBackoff)
+		}
+	}
+
+	// Containers that stopped starting are forgotten once the window has passed
+	dw.recordStart("other", now)
+	dw.recordStart("another", now.Add(crashLoopWindow))
+	if _, ok := dw.starts["other"]; ok {
+		t.Error("starts of a container outside the window were not pruned")
+	}
+
+	// The pending recheck is abandoned when the watcher stops
+	dw.cancel()
+	done := make(chan struct{})
+	go func() {
+		dw.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("crash-loop recheck still pending after the watcher stopped")
+	}
+}
+
+func TestWaitRunning(t *testing.T) {
+	dw := newTestWatcher(t)
+	running := newFakeContainer("web", nil)
+	running.State.Running = true
+	dw.client = fakeDockerClient{fakeContainerLister{
+		"running": running,
+		"exited":  newFakeContainer("worker", nil),
+	}}
+
+	results := map[string]chan bool{"running": make(chan bool, 1), "exited": make(chan bool, 1)}
+	for id, result := range results {
+		go func() { result <- dw.waitRunning(id) }()
+	}
+	if !<-results["running"] {
+		t.Error("waitRunning() = false for a container still running after the settle delay")
+	}
+	if <-results["exited"] {
+		t.Error("waitRunning() = true for a container that exited")
+	}
+
+	dw.cancel()
+	if dw.waitRunning("running") {
+		t.Error("waitRunning() = true after the watcher stopped")
+	}
+}
+
+func TestStateEligible(t *testing.T) {
+	tests := []struct {
+		name          string
+		includeStates []string
+		status        string
+		want          bool
+	}{
+		{name: "any state by default", status: container.StatePaused, want: true},
+		{name: "included state", includeStates: []string{"running", "restarting"}, status: container.StateRestarting, want: true},
+		{name: "excluded state", includeStates: []string{"running"}, status: container.StatePaused, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dw := &DockerWatcher{config: &DockerConfig{IncludeStates: tt.includeStates}}
+			if got := dw.stateEligible(&container.State{Status: tt.status}); got != tt.want {
+				t.Errorf("stateEligible(%q) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	labels := map[string]string{
+		"tailnet.enabled":      "true",
+		"tailnet.port":         "8080",
+		"webtail.port":         "9090",
+		swarmNodeIDLabel:       "node-1",
+		"com.example.whatever": "kept",
+	}
+
+	dw := &DockerWatcher{config: &DockerConfig{LabelPrefix: "tailnet"}}
+	got := dw.normalizeLabels(labels)
+	want := map[string]string{
+		labelEnabled:           "true",
+		labelPort:              "8080",
+		swarmNodeIDLabel:       "node-1",
+		"com.example.whatever": "kept",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("normalizeLabels() = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("normalizeLabels()[%q] = %q, want %q", key, got[key], value)
+		}
+	}
+
+	dw = &DockerWatcher{config: &DockerConfig{}}
+	if got := dw.normalizeLabels(labels); got[labelPort] != "9090" {
+		t.Errorf("normalizeLabels() without label_prefix changed %s to %q", labelPort, got[labelPort])
+	}
+}
+
+func TestNodeNameAllowed(t *testing.T) {
+	dw := &DockerWatcher{config: &DockerConfig{}}
+	if !dw.nodeNameAllowed("anything") {
+		t.Error("nodeNameAllowed() without allowed_node_names = false, want true")
+	}
+
+	dw.config.AllowedNodeNames = []string{"grafana", "plex"}
+	if !dw.nodeNameAllowed("plex") {
+		t.Error("nodeNameAllowed(plex) = false, want true")
+	}
+	if dw.nodeNameAllowed("admin") {
+		t.Error("nodeNameAllowed(admin) = true, want false")
+	}
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	dw := newTestWatcher(t)
+	for i := 0; i < 4; i++ {
+		dw.eventQueues = append(dw.eventQueues, make(chan events.Message, 8))
+	}
+
+	for _, action := range []events.Action{events.ActionCreate, events.ActionStart, events.ActionHealthStatusHealthy} {
+		dw.enqueueEvent(events.Message{Action: action, Actor: events.Actor{ID: "4f66ad9a0b2e"}})
+	}
+
+	// All events for one container land in one queue, in order
+	for _, queue := range dw.eventQueues {
+		if len(queue) == 0 {
+			continue
+		}
+		if len(queue) != 3 {
+			t.Fatalf("queue holds %d events, want all 3", len(queue))
+		}
+		for _, want := range []events.Action{events.ActionCreate, events.ActionStart, events.ActionHealthStatusHealthy} {
+			if got := (<-queue).Action; got != want {
+				t.Errorf("dequeued %s, want %s", got, want)
+			}
+		}
+	}
+}
+
+func TestEventRateInterval(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want time.Duration
+	}{
+		{rate: 5, want: 200 * time.Millisecond},
+		{rate: 0.5, want: 2 * time.Second},
+		{rate: 1e9, want: time.Nanosecond},
+		{rate: 5e9, want: time.Nanosecond}, // would truncate to zero and make NewTicker panic
+	}
+
+	for _, tt := range tests {
+		if got := eventRateInterval(tt.rate); got != tt.want {
+			t.Errorf("eventRateInterval(%g) = %s, want %s", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestProbeFallbackPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	open := listener.Addr().(*net.TCPAddr).Port
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	closed := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	if got, want := probeFallbackPorts(context.Background(), "127.0.0.1", []int{closed, open}), strconv.Itoa(open); got != want {
+		t.Errorf("probeFallbackPorts() = %q, want %q", got, want)
+	}
+	if got := probeFallbackPorts(context.Background(), "127.0.0.1", []int{closed}); got != "" {
+		t.Errorf("probeFallbackPorts() with no listening port = %q, want empty", got)
+	}
+}
+
+// fakeDockerClient serves canned containers to the watcher in place of a daemon
+type fakeDockerClient struct {
+	fakeContainerLister
+}
+
+func (f fakeDockerClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
+
+func (f fakeDockerClient) Info(ctx context.Context) (system.Info, error) {
+	return system.Info{}, nil
+}
+
+func (f fakeDockerClient) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, nil
+}
+
+func (f fakeDockerClient) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	return network.Inspect{Name: networkID}, nil
+}
+
+func (f fakeDockerClient) DaemonHost() string { return "unix:///var/run/docker.sock" }
+
+func (f fakeDockerClient) Close() error { return nil }
+
+// newFakeContainer returns an inspected container with the given labels and exposed ports
+func newFakeContainer(name string, labels map[string]string, ports ...nat.Port) container.InspectResponse {
+	exposed := nat.PortSet{}
+	for _, port := range ports {
+		exposed[port] = struct{}{}
+	}
+	return container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Name: "/" + name, State: &container.State{Status: container.StateRunning}},
+		Config:            &container.Config{Labels: labels, ExposedPorts: exposed},
+	}
+}
+
+func TestContainerServiceConfig(t *testing.T) {
+	enabled := func(labels map[string]string) map[string]string {
+		all := map[string]string{labelEnabled: "true"}
+		for key, value := range labels {
+			all[key] = value
+		}
+		return all
+	}
+
+	tests := []struct {
+		name         string
+		container    container.InspectResponse
+		config       DockerConfig
+		wantTarget   string
+		wantNodeName string
+		wantPassHost bool
+	}{
+		{
+			name:      "not enabled",
+			container: newFakeContainer("web", map[string]string{labelPort: "80"}, "80/tcp"),
+		},
+		{
+			name:      "enabled false",
+			container: newFakeContainer("web", map[string]string{labelEnabled: "false"}, "80/tcp"),
+		},
+		{
+			name:         "lowest exposed port and default protocol",
+			container:    newFakeContainer("web", enabled(nil), "8080/tcp", "80/tcp"),
+			wantTarget:   "http://web.webtail:80",
+			wantNodeName: "web",
+		},
+		{
+			name:         "port, protocol and node name labels",
+			container:    newFakeContainer("web", enabled(map[string]string{labelPort: "9000", labelProtocol: "https", labelNodeName: "dashboard"}), "80/tcp"),
+			wantTarget:   "https://web.webtail:9000",
+			wantNodeName: "dashboard",
+		},
+		{
+			name:      "no port label and no exposed ports",
+			container: newFakeContainer("worker", enabled(nil)),
+		},
+		{
+			name:         "protocol inferred from tls port",
+			container:    newFakeContainer("unifi", enabled(nil), "8443/tcp"),
+			config:       DockerConfig{InferProtocolFromPort: true},
+			wantTarget:   "https://unifi.webtail:8443",
+			wantNodeName: "unifi",
+		},
+		{
+			name:         "tls port without inference",
+			container:    newFakeContainer("unifi", enabled(nil), "8443/tcp"),
+			wantTarget:   "http://unifi.webtail:8443",
+			wantNodeName: "unifi",
+		},
+		{
+			name:         "node name sanitized",
+			container:    newFakeContainer("my_app", enabled(map[string]string{labelPassHostHeader: "true"}), "3000/tcp"),
+			wantTarget:   "http://my_app.webtail:3000",
+			wantNodeName: "my-app",
+			wantPassHost: true,
+		},
+		{
+			name:      "node name not allowed",
+			container: newFakeContainer("web", enabled(nil), "80/tcp"),
+			config:    DockerConfig{AllowedNodeNames: []string{"grafana"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dw := newTestWatcher(t)
+			tt.config.Network = "webtail"
+			dw.config = &tt.config
+			dw.dockerNetwork = tt.config.Network
+			dw.defaults = &DefaultsConfig{}
+			dw.client = fakeDockerClient{fakeContainerLister{"c1": tt.container}}
+
+			got, err := dw.containerServiceConfig("c1", true)
+			if err != nil {
+				t.Fatalf("containerServiceConfig() error = %v", err)
+			}
+			if tt.wantTarget == "" {
+				if got != nil {
+					t.Errorf("containerServiceConfig() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("containerServiceConfig() = nil, want a service")
+			}
+			if got.Target != tt.wantTarget || got.NodeName != tt.wantNodeName {
+				t.Errorf("target, node name = %q, %q, want %q, %q", got.Target, got.NodeName, tt.wantTarget, tt.wantNodeName)
+			}
+			if passHost := boolValue(got.PassHostHeader, false); passHost != tt.wantPassHost {
+				t.Errorf("pass_host_header = %v, want %v", passHost, tt.wantPassHost)
+			}
+		})
+	}
+}
+
+func TestContainerServiceConfigFallbackPorts(t *testing.T) {
+	dw := newTestWatcher(t)
+	dw.config = &DockerConfig{Network: "webtail", FallbackPorts: []int{8080}}
+	dw.dockerNetwork = "webtail"
+	dw.defaults = &DefaultsConfig{}
+	dw.client = fakeDockerClient{fakeContainerLister{"c1": newFakeContainer("web", map[string]string{labelEnabled: "true"})}}
+
+	// Without probing, the port is left for the start goroutine to resolve once the container settled
+	got, err := dw.containerServiceConfig("c1", false)
+	if err != nil {
+		t.Fatalf("containerServiceConfig() error = %v", err)
+	}
+	if got == nil || got.NodeName != "web" || got.Target != "" {
+		t.Errorf("containerServiceConfig(probe=false) = %+v, want service web without a target", got)
+	}
+}
+
+func TestHandleContainerSkipped(t *testing.T) {
+	dw := newTestWatcher(t)
+	dw.config = &DockerConfig{Network: "webtail"}
+	dw.dockerNetwork = "webtail"
+	dw.defaults = &DefaultsConfig{}
+	dw.proxies = make(map[string]*Proxy)
+	dw.pending = make(map[string]bool)
+	// Without an auth key, nodes with no saved state would wait for an interactive login
+	dw.tsConfig = &TailscaleConfig{StateDir: t.TempDir()}
+	dw.client = fakeDockerClient{fakeContainerLister{
+		"disabled": newFakeContainer("web", nil, "80/tcp"),
+		"no-ports": newFakeContainer("worker", map[string]string{labelEnabled: "true"}),
+		"no-state": newFakeContainer("api", map[string]string{labelEnabled: "true"}, "80/tcp"),
+	}}
+
+	for _, id := range []string{"disabled", "no-ports", "no-state"} {
+		if err := dw.handleContainer(id, false); err != nil {
+			t.Errorf("handleContainer(%s) error = %v", id, err)
+		}
+	}
+	if len(dw.proxies) != 0 || len(dw.pending) != 0 {
+		t.Errorf("proxies = %v, pending = %v, want none for skipped containers", dw.proxies, dw.pending)
+	}
+}
+
+// failingDockerClient is a fake Docker client whose network and container
+// lookups fail with the given errors, and which records being closed
+type failingDockerClient struct {
+	fakeDockerClient
+	networkErr error
+	inspectErr error
+	closed     atomic.Bool
+}
+
+func (f *failingDockerClient) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	if f.networkErr != nil {
+		return network.Inspect{}, f.networkErr
+	}
+	return f.fakeDockerClient.NetworkInspect(ctx, networkID, options)
+}
+
+func (f *failingDockerClient) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	if f.inspectErr != nil {
+		return container.InspectResponse{}, f.inspectErr
+	}
+	return f.fakeDockerClient.ContainerInspect(ctx, containerID)
+}
+
+func (f *failingDockerClient) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		name       string
+		networkErr error
+		inspectErr error
+		wantErr    bool
+	}{
+		{name: "missing network", networkErr: errors.New("network not found"), wantErr: true},
+		{name: "container errors don't fail the scan", inspectErr: errors.New("inspect failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dw := newTestWatcher(t)
+			dw.config = &DockerConfig{Network: "webtail", RequireNetwork: true, RequireInitialScan: true}
+			dw.dockerNetwork = "webtail"
+			dw.defaults = &DefaultsConfig{}
+			dw.proxies = make(map[string]*Proxy)
+			dw.pending = make(map[string]bool)
+			dw.tsConfig = &TailscaleConfig{StateDir: t.TempDir()}
+			client := &failingDockerClient{
+				fakeDockerClient: fakeDockerClient{fakeContainerLister{
+					"web": newFakeContainer("web", map[string]string{labelEnabled: "true"}, "80/tcp"),
+				}},
+				networkErr: tt.networkErr,
+				inspectErr: tt.inspectErr,
+			}
+			dw.client = client
+
+			err := dw.Start()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errInitialScanFailed) {
+				t.Errorf("Start() error = %v, want it not to be reported as a failed scan", err)
+			}
+			if err == nil {
+				dw.Stop()
+			}
+
+			// Whether Start failed or the watcher was stopped, nothing may be left running
+			if dw.ctx.Err() == nil {
+				t.Error("watcher context not canceled")
+			}
+			if !client.closed.Load() {
+				t.Error("Docker client not closed")
+			}
+		})
+	}
+}
+
+func TestStripNameAffixes(t *testing.T) {
+	dw := &DockerWatcher{config: &DockerConfig{
+		StripNamePrefixes: []string{"myproject-", "myproject_"},
+		StripNameSuffixes: []string{"-1", "_1"},
+	}}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "myproject-web-1", want: "web"},
+		{name: "myproject_db_1", want: "db"},
+		{name: "myproject-web-2", want: "web-2"},
+		{name: "other-web-1", want: "other-web"},
+		{name: "plex", want: "plex"},
+		{name: "myproject-", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dw.stripNameAffixes(tt.name); got != tt.want {
+				t.Errorf("stripNameAffixes(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Upstream error classes that can be mapped to custom responses
+const (
+	errorClassDial    = "dial"
+	errorClassTimeout = "timeout"
+	errorClassTLS     = "tls"
+)
+
+// errorClasses lists the valid keys for a service's error_responses
+var errorClasses = map[string]bool{
+	errorClassDial:    true,
+	errorClassTimeout: true,
+	errorClassTLS:     true,
+}
+
+// classifyUpstreamError returns the error class of a failed upstream request,
+// or an empty string if it doesn't match a known class
+func classifyUpstreamError(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorClassTimeout
+	}
+
+	var (
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &verifyErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return errorClassTLS
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if (errors.As(err, &opErr) && opErr.Op == "dial") || errors.As(err, &dnsErr) {
+		return errorClassDial
+	}
+
+	return ""
+}
+
+// isUnresolvedHost reports whether err is the target's hostname not resolving,
+// e.g. a container that hasn't started yet
+func isUnresolvedHost(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isStaleConnection reports whether err suggests the target's address changed:
+// dialing it failed or it reset the connection. Timeouts and TLS errors don't.
+func isStaleConnection(err error) bool {
+	return classifyUpstreamError(err) == errorClassDial || errors.Is(err, syscall.ECONNRESET)
+}
+
+// handleError writes the response for a request that could not be forwarded
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	class := classifyUpstreamError(err)
+	p.logf(levelWarn, "Upstream error for %s (%s): %v", p.config.NodeName, class, err)
+
+	// Pooled connections may point at an address the target no longer has,
+	// e.g. a recreated container; drop them so the next request re-resolves
+	if isStaleConnection(err) {
+		p.CloseIdleConnections()
+	}
+
+	// Send connection failures to the fallback target when one is configured.
+	// The fallback's response is what the breaker records for the request.
+	if class == errorClassDial {
+		if fallback, ok := fallbackRequest(r); ok {
+			p.logf(levelInfo, "Routing %s %s for %s to fallback %s", r.Method, fallback.URL.Path, p.config.NodeName, fallback.URL.Host)
+			p.forwarder.ServeHTTP(w, fallback)
+			return
+		}
+	}
+
+	// Client disconnects say nothing about the backend's health
+	if !errors.Is(err, context.Canceled) {
+		p.recordResult(true)
+	}
+
+	response, ok := p.config.ErrorResponses[class]
+	if !ok || class == "" {
+		// Targets are resolved per request, so a backend that isn't up yet is
+		// temporarily unavailable rather than a broken gateway
+		if isUnresolvedHost(err) {
+			http.Error(w, "Service is not available yet", http.StatusServiceUnavailable)
+			return
+		}
+		utils.DefaultHandler.ServeHTTP(w, r, err)
+		return
+	}
+
+	body := response.Body
+	if body == "" {
+		body = http.StatusText(response.Status)
+	}
+	http.Error(w, body, response.Status)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// fallbackRequestKey is the context key holding the request addressed to the fallback target
+type fallbackRequestKey struct{}
+
+// withFallbackRequest attaches a copy of the request addressed to the service's
+// fallback target, which handleError forwards if the primary can't be reached
+func (p *Proxy) withFallbackRequest(r *http.Request) *http.Request {
+	fallbackURL, err := parseTarget(p.config.FallbackTarget)
+	if err != nil {
+		p.logf(levelError, "Failed to parse fallback target URL %s: %v", p.config.FallbackTarget, err)
+		return r
+	}
+
+	fallback := r.Clone(r.Context())
+	fallback.URL.Scheme = fallbackURL.Scheme
+	fallback.URL.Host = fallbackURL.Host
+
+	return r.WithContext(context.WithValue(r.Context(), fallbackRequestKey{}, fallback))
+}
+
+// fallbackRequest returns the fallback copy of a request, if it has one that can be replayed.
+// Requests with a body are never replayed since the failed attempt may have consumed it.
+func fallbackRequest(r *http.Request) (*http.Request, bool) {
+	fallback, ok := r.Context().Value(fallbackRequestKey{}).(*http.Request)
+	if !ok || (fallback.Body != nil && fallback.Body != http.NoBody) {
+		return nil, false
+	}
+	return fallback, true
+}
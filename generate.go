@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// generatedConfig is the starter config printed by generate-config
+type generatedConfig struct {
+	Version   int             `json:"version"`
+	Tailscale TailscaleConfig `json:"tailscale"`
+	Services  []ServiceConfig `json:"services"`
+}
+
+// runGenerateConfig implements the generate-config subcommand: it proposes a
+// service for every running container with an exposed port and prints the config
+func runGenerateConfig(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("generate-config", flag.ContinueOnError)
+	network := flags.String("network", "", "Docker network shared with webtail; targets become {container}.{network}")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	config, err := generateConfig(context.Background(), cli, *network)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config)
+}
+
+// containerLister is the part of the Docker client generate-config uses
+type containerLister interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
+	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+}
+
+// generateConfig builds a starter config from the running containers
+func generateConfig(ctx context.Context, cli containerLister, network string) (*generatedConfig, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	config := &generatedConfig{
+		Version:   currentConfigVersion,
+		Tailscale: TailscaleConfig{AuthKey: "${TS_AUTHKEY}"},
+		Services:  []ServiceConfig{},
+	}
+	for _, c := range containers {
+		inspect, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			log.Printf("Skipping container %s: %v", shortID(c.ID), err)
+			continue
+		}
+
+		name := strings.TrimPrefix(inspect.Name, "/")
+		port := getLowestExposedPort(inspect.Config.ExposedPorts)
+		if port == "" {
+			log.Printf("Skipping container %s (%s): no exposed ports", shortID(c.ID), name)
+			continue
+		}
+		nodeName := sanitizeHostname(name)
+		if nodeName == "" {
+			log.Printf("Skipping container %s (%s): name is not a valid hostname", shortID(c.ID), name)
+			continue
+		}
+
+		protocol := defaultProtocol
+		if tlsPorts[port] {
+			protocol = "https"
+		}
+		host := name
+		if network != "" {
+			host = name + "." + network
+		}
+
+		config.Services = append(config.Services, ServiceConfig{
+			Target:   fmt.Sprintf("%s://%s:%s", protocol, host, port),
+			NodeName: nodeName,
+		})
+	}
+
+	sort.Slice(config.Services, func(i, j int) bool {
+		return config.Services[i].NodeName < config.Services[j].NodeName
+	})
+	return config, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// fakeContainerLister serves canned containers, keyed by ID
+type fakeContainerLister map[string]container.InspectResponse
+
+func (f fakeContainerLister) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	var summaries []container.Summary
+	for id := range f {
+		summaries = append(summaries, container.Summary{ID: id})
+	}
+	return summaries, nil
+}
+
+func (f fakeContainerLister) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	inspect, ok := f[containerID]
+	if !ok {
+		return container.InspectResponse{}, fmt.Errorf("no such container: %s: %w", containerID, cerrdefs.ErrNotFound)
+	}
+	return inspect, nil
+}
+
+func TestGenerateConfig(t *testing.T) {
+	newContainer := func(name string, ports ...nat.Port) container.InspectResponse {
+		exposed := nat.PortSet{}
+		for _, port := range ports {
+			exposed[port] = struct{}{}
+		}
+		return container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{Name: "/" + name},
+			Config:            &container.Config{ExposedPorts: exposed},
+		}
+	}
+	cli := fakeContainerLister{
+		"a": newContainer("Grafana", "3000/tcp"),
+		"b": newContainer("unifi", "8443/tcp", "8080/tcp"),
+		"c": newContainer("worker"),
+	}
+
+	config, err := generateConfig(context.Background(), cli, "webtail")
+	if err != nil {
+		t.Fatalf("generateConfig() error = %v", err)
+	}
+
+	want := []ServiceConfig{
+		{Target: "http://Grafana.webtail:3000", NodeName: "grafana"},
+		{Target: "http://unifi.webtail:8080", NodeName: "unifi"},
+	}
+	if len(config.Services) != len(want) {
+		t.Fatalf("generateConfig() services = %+v, want %+v", config.Services, want)
+	}
+	for i, service := range config.Services {
+		if service.Target != want[i].Target || service.NodeName != want[i].NodeName {
+			t.Errorf("services[%d] = %s -> %s, want %s -> %s", i, service.NodeName, service.Target, want[i].NodeName, want[i].Target)
+		}
+	}
+}
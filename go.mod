@@ -3,6 +3,7 @@ module webtail
 go 1.25.0
 
 require (
+	github.com/containerd/errdefs v0.3.0
 	github.com/docker/docker v28.2.2+incompatible
 	github.com/vulcand/oxy v1.4.2
 	tailscale.com v1.86.5
@@ -29,7 +30,6 @@ require (
 	github.com/aws/smithy-go v1.22.2 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/coder/websocket v1.8.12 // indirect
-	github.com/containerd/errdefs v0.3.0 // indirect
 	github.com/containerd/errdefs/pkg v0.3.0 // indirect
 	github.com/coreos/go-iptables v0.7.1-0.20240112124308-65c67c9f46e6 // indirect
 	github.com/dblohm7/wingoes v0.0.0-20240119213807-a09d6be7affa // indirect
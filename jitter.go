@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// jitter returns interval randomly lengthened or shortened by up to fraction of
+// it, so periodic loops started together don't stay in lockstep
+func jitter(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*fraction*float64(interval))
+}
+
+// everyJittered calls fn about every interval, varied by up to fraction each
+// time, until ctx is done
+func everyJittered(ctx context.Context, interval time.Duration, fraction float64, fn func(now time.Time)) {
+	timer := time.NewTimer(jitter(interval, fraction))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			fn(now)
+			timer.Reset(jitter(interval, fraction))
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	if got := jitter(time.Minute, 0); got != time.Minute {
+		t.Errorf("jitter() without a fraction = %s, want %s", got, time.Minute)
+	}
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		got := jitter(time.Minute, 0.1)
+		if got < 54*time.Second || got > 66*time.Second {
+			t.Fatalf("jitter(1m, 0.1) = %s, want within 10%% of 1m", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter() returned the same interval every time")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// logDeduper collapses an error repeated within window of when it was last
+// logged, so retry loops don't flood the logs during sustained outages
+type logDeduper struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	last    string
+	logged  time.Time
+	repeats int
+}
+
+// newLogDeduper returns a deduper for window, or nil (logging everything) if window is 0
+func newLogDeduper(window time.Duration) *logDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &logDeduper{window: window}
+}
+
+// check reports whether message should be logged and how many repeats of the
+// previous message were suppressed since it was last logged
+func (d *logDeduper) check(message string, now time.Time) (bool, int) {
+	if d == nil {
+		return true, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if message == d.last && now.Sub(d.logged) < d.window {
+		d.repeats++
+		return false, 0
+	}
+	repeats := d.repeats
+	d.last, d.logged, d.repeats = message, now, 0
+	return true, repeats
+}
+
+// flush returns the number of suppressed repeats not reported yet and forgets
+// the last message, e.g. once the retry loop is over
+func (d *logDeduper) flush() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	repeats := d.repeats
+	d.last, d.repeats = "", 0
+	return repeats
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogDeduper(t *testing.T) {
+	d := newLogDeduper(time.Minute)
+	now := time.Now()
+
+	steps := []struct {
+		message     string
+		after       time.Duration
+		wantLog     bool
+		wantRepeats int
+	}{
+		{message: "control plane unreachable", wantLog: true},
+		{message: "control plane unreachable", after: 10 * time.Second, wantLog: false},
+		{message: "control plane unreachable", after: 20 * time.Second, wantLog: false},
+		{message: "auth key expired", after: 30 * time.Second, wantLog: true, wantRepeats: 2},
+		{message: "auth key expired", after: 40 * time.Second, wantLog: false},
+		{message: "auth key expired", after: 100 * time.Second, wantLog: true, wantRepeats: 1},
+	}
+	for i, step := range steps {
+		gotLog, gotRepeats := d.check(step.message, now.Add(step.after))
+		if gotLog != step.wantLog || gotRepeats != step.wantRepeats {
+			t.Errorf("step %d: check(%q) = %v, %d, want %v, %d", i, step.message, gotLog, gotRepeats, step.wantLog, step.wantRepeats)
+		}
+	}
+
+	d.check("auth key expired", now.Add(110*time.Second))
+	if got := d.flush(); got != 1 {
+		t.Errorf("flush() = %d, want 1", got)
+	}
+	if got := d.flush(); got != 0 {
+		t.Errorf("second flush() = %d, want 0", got)
+	}
+	if ok, _ := d.check("auth key expired", now.Add(120*time.Second)); !ok {
+		t.Error("check() after flush suppressed the message")
+	}
+}
+
+func TestLogDeduperDisabled(t *testing.T) {
+	d := newLogDeduper(0)
+	for range 3 {
+		if ok, repeats := d.check("error", time.Now()); !ok || repeats != 0 {
+			t.Errorf("check() = %v, %d, want true, 0", ok, repeats)
+		}
+	}
+	if got := d.flush(); got != 0 {
+		t.Errorf("flush() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat is the timestamp suffix of rotated log files
+const rotatedTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is rotated by size and age and can be
+// reopened after an external tool such as logrotate has moved it
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+}
+
+// openRotatingFile opens a log file for appending; a zero maxSize or maxAge disables
+// that limit, and a zero maxBackups keeps every rotated file
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	file, size, err := openLogPath(path)
+	if err != nil {
+		return nil, err
+	}
+	rf.swap(file, size)
+	return rf, nil
+}
+
+// openLogPath opens a log file for appending, creating it and its directory if
+// needed, and returns its current size
+func openLogPath(path string) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	return file, info.Size(), nil
+}
+
+// swap closes the current log file, if any, and continues with file
+func (rf *rotatingFile) swap(file *os.File, size int64) {
+	if rf.file != nil {
+		rf.file.Close()
+	}
+	rf.file = file
+	rf.size = size
+	rf.openedAt = time.Now()
+}
+
+// Write appends to the log file, rotating it first if a limit would be exceeded
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && ((rf.maxSize > 0 && rf.size+int64(len(b)) > rf.maxSize) ||
+		(rf.maxAge > 0 && time.Since(rf.openedAt) >= rf.maxAge)) {
+		// Logs keep going to the current file rather than being lost; the next
+		// attempt waits for the limit to be reached again
+		if err := rf.rotate(); err != nil {
+			log.Printf("Failed to rotate log file %s: %v", rf.path, err)
+			rf.size, rf.openedAt = 0, time.Now()
+		}
+	}
+
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current log file aside with a timestamp suffix, starts a new
+// one and removes rotated files beyond maxBackups. The current file stays open
+// if a new one can't be started.
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(rf.path, rotated); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	file, size, err := openLogPath(rf.path)
+	if err != nil {
+		return err
+	}
+	rf.swap(file, size)
+
+	if err := rf.removeOldBackups(); err != nil {
+		log.Printf("Failed to remove old log files of %s: %v", rf.path, err)
+	}
+	return nil
+}
+
+// removeOldBackups deletes the oldest rotated log files so that at most
+// maxBackups are kept
+func (rf *rotatingFile) removeOldBackups() error {
+	if rf.maxBackups <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return err
+	}
+	// Only files named by rotate count, not e.g. ones moved aside by logrotate
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(match, rf.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	if len(backups) <= rf.maxBackups {
+		return nil
+	}
+
+	// Timestamp suffixes sort chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-rf.maxBackups] {
+		if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reopen reopens the log file at its configured path, keeping the current one
+// if that fails
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	file, size, err := openLogPath(rf.path)
+	if err != nil {
+		return err
+	}
+	rf.swap(file, size)
+	return nil
+}
+
+// Close closes the log file
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.file.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "app.log")
+
+	rf, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// The second write exceeds the size limit and rotates the first one away
+	if data, _ := os.ReadFile(path); string(data) != "second\n" {
+		t.Errorf("log file = %q, want %q", data, "second\n")
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files = %v, want 1", rotated)
+	}
+	if data, _ := os.ReadFile(rotated[0]); string(data) != "first\n" {
+		t.Errorf("rotated file = %q, want %q", data, "first\n")
+	}
+
+	// Reopen follows the path after the file was moved away externally
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := rf.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	if _, err := rf.Write([]byte("third\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "third\n" {
+		t.Errorf("log file after reopen = %q, want %q", data, "third\n")
+	}
+}
+
+func TestRotatingFileMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	rf, err := openRotatingFile(path, 5, 0, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer rf.Close()
+
+	// Files moved aside by another tool are left alone
+	if err := os.WriteFile(path+".moved", nil, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := rf.Write([]byte(fmt.Sprintf("line%d\n", i))); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		// Rotated files are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 3 {
+		t.Fatalf("files next to the log = %v, want the 2 newest rotated files and the moved one", matches)
+	}
+	for _, want := range []string{"line2\n", "line3\n"} {
+		found := false
+		for _, match := range matches {
+			if data, _ := os.ReadFile(match); string(data) == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no rotated file contains %q", want)
+		}
+	}
+}
+
+func TestRotatingFileReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "app.log")
+
+	rf, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer rf.Close()
+
+	// A file where the log directory was makes reopening fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := rf.Reopen(); err == nil {
+		t.Fatal("Reopen() error = nil, want an error")
+	}
+
+	// Logs keep going to the file that was open
+	if _, err := rf.Write([]byte("still logging\n")); err != nil {
+		t.Errorf("Write() after failed Reopen error = %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// logLevel orders log severities for per-service filtering
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps configuration values to log levels
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// parseLogLevel parses a log level name, defaulting to info when empty
+func parseLogLevel(value string) (logLevel, error) {
+	if value == "" {
+		return levelInfo, nil
+	}
+	level, ok := logLevels[strings.ToLower(value)]
+	if !ok {
+		return levelInfo, fmt.Errorf("unknown log level %q (must be debug, info, warn or error)", value)
+	}
+	return level, nil
+}
+
+// logf logs a message for this proxy if it meets the service's log level
+func (p *Proxy) logf(level logLevel, format string, args ...any) {
+	if level < p.logLevel {
+		return
+	}
+	if p.logger != nil {
+		p.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// openLogFile directs the proxy's logs to its log_file, if configured
+func (p *Proxy) openLogFile() error {
+	if p.config.LogFile == "" || p.logFile != nil {
+		return nil
+	}
+
+	path := strings.ReplaceAll(p.config.LogFile, "{node_name}", p.config.NodeName)
+	file, err := openRotatingFile(path, int64(p.config.LogMaxSize)<<20, time.Duration(p.config.LogMaxAge),
+		intValue(p.config.LogMaxBackups, defaultLogMaxBackups))
+	if err != nil {
+		return fmt.Errorf("failed to open log file for %s: %w", p.config.NodeName, err)
+	}
+
+	p.logFile = file
+	p.logger = log.New(file, "", log.LstdFlags)
+	return nil
+}
+
+// ReopenLog reopens the proxy's log file so logs follow a file moved by logrotate
+func (p *Proxy) ReopenLog() {
+	if p.logFile == nil {
+		return
+	}
+	if err := p.logFile.Reopen(); err != nil {
+		log.Printf("Failed to reopen log file for %s: %v", p.config.NodeName, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// loopHeader lists the webtail nodes a request was forwarded by, so a
+// request reaching the same node again is recognized as a proxy loop
+const loopHeader = "X-Webtail-Via"
+
+// targets returns every upstream the proxy may forward to
+func (p *Proxy) targets() []string {
+	var targets []string
+	for _, target := range []string{p.config.Target, p.config.FallbackTarget, p.config.MirrorTarget} {
+		if target != "" {
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range p.config.PathRoutes {
+		targets = append(targets, target)
+	}
+	for _, route := range p.config.HeaderRoutes {
+		targets = append(targets, route.Target)
+	}
+	for _, listener := range p.config.Listeners {
+		targets = append(targets, listener.Target)
+	}
+	return targets
+}
+
+// selfTarget returns the first target pointing back at the proxy's own node,
+// by one of its tailnet domains or IPs
+func (p *Proxy) selfTarget(domains []string, ips []netip.Addr) (string, bool) {
+	for _, target := range p.targets() {
+		targetURL, err := parseTarget(target)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSuffix(targetURL.Hostname(), "."))
+		for _, domain := range domains {
+			if host == strings.ToLower(strings.TrimSuffix(domain, ".")) {
+				return target, true
+			}
+		}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			for _, ip := range ips {
+				if addr.Unmap() == ip.Unmap() {
+					return target, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// isLoop reports whether the request was already forwarded by this node
+func (p *Proxy) isLoop(r *http.Request) bool {
+	for _, value := range r.Header.Values(loopHeader) {
+		for _, node := range strings.Split(value, ",") {
+			if strings.TrimSpace(node) == p.config.NodeName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -21,8 +24,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Print a starter config for the running containers
+	if len(os.Args) > 1 && os.Args[1] == "generate-config" {
+		if err := runGenerateConfig(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Failed to generate configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// Parse command-line flags
-	configPath := flag.String("config", "config.json", "Path to configuration file")
+	configPath := flag.String("config", "config.json", "Path or http(s) URL of configuration file, or - to read it from stdin")
 	dockerEnabled := flag.Bool("docker", false, "Enable Docker container discovery")
 	flag.Parse()
 
@@ -45,28 +56,46 @@ func main() {
 	var wg sync.WaitGroup
 
 	startedProxies := 0
-	for _, proxy := range proxies {
+	startErrs := make([]error, len(proxies))
+	for i, proxy := range proxies {
 		wg.Add(1)
 		go func(p *Proxy) {
 			defer wg.Done()
 			if err := p.Start(); err != nil {
-				log.Printf("Failed to start proxy for %s: %v", p.config.NodeName, err)
+				startErrs[i] = err
+				p.logf(levelError, "Failed to start proxy for %s: %v", p.config.NodeName, err)
 				return
 			}
-			log.Printf("Started proxy for %s", p.config.NodeName)
+			p.logf(levelInfo, "Started proxy for %s", p.config.NodeName)
 		}(proxy)
 		startedProxies++
 	}
 
+	// Report how the config-based proxies came up once every start attempt has settled
+	if len(proxies) > 0 {
+		go func() {
+			wg.Wait()
+			for _, line := range startupSummary(proxies, startErrs) {
+				log.Print(line)
+			}
+		}()
+	}
+
 	// Start Docker watcher if enabled
 	var dockerWatcher *DockerWatcher
 	if *dockerEnabled {
 		log.Printf("Docker discovery enabled on network %q, starting Docker watcher...", config.Docker.Network)
-		dockerWatcher, err = NewDockerWatcher(&config.Tailscale, &config.Docker)
+		if config.Tailscale.AuthKey == "" && !config.Tailscale.usesOAuth() {
+			log.Println("Warning: no tailscale auth_key configured, containers whose nodes have no saved state are skipped")
+		}
+		dockerWatcher, err = NewDockerWatcher(&config.Tailscale, &config.Docker, &config.Defaults)
 		if err != nil {
 			log.Printf("Warning: Failed to create Docker watcher: %v", err)
 		} else {
 			if err := dockerWatcher.Start(); err != nil {
+				if errors.Is(err, errInitialScanFailed) || errors.Is(err, errDockerUnreachable) {
+					log.Fatalf("Failed to start Docker watcher: %v", err)
+				}
 				log.Printf("Warning: Failed to start Docker watcher: %v", err)
 				dockerWatcher = nil
 			}
@@ -85,11 +114,31 @@ func main() {
 	}
 	log.Println("Press Ctrl+C to stop.")
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal; SIGUSR1 drains proxies ahead of a later stop
+	// and SIGHUP reopens per-service log files after rotation
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
+
+waitLoop:
+	for sig := range sigChan {
+		switch sig {
+		case syscall.SIGUSR1:
+			log.Println("Received drain signal, draining proxies...")
+			for _, proxy := range proxies {
+				proxy.Drain()
+			}
+			if dockerWatcher != nil {
+				dockerWatcher.Drain()
+			}
+		case syscall.SIGHUP:
+			log.Println("Received SIGHUP, reopening log files...")
+			for _, proxy := range proxies {
+				proxy.ReopenLog()
+			}
+		default:
+			break waitLoop
+		}
+	}
 	log.Println("Received shutdown signal, stopping...")
 
 	// Stop Docker watcher first
@@ -109,7 +158,7 @@ func main() {
 			go func(p *Proxy) {
 				defer stopWg.Done()
 				if err := p.Stop(); err != nil {
-					log.Printf("Error stopping proxy for %s: %v", p.config.NodeName, err)
+					p.logf(levelError, "Error stopping proxy for %s: %v", p.config.NodeName, err)
 				}
 			}(proxy)
 		}
@@ -127,3 +176,24 @@ func main() {
 
 	log.Println("Shutdown complete")
 }
+
+// startupSummary returns the log lines reporting the outcome of starting the
+// config-based proxies: one line with the totals followed by one per failure
+func startupSummary(proxies []*Proxy, errs []error) []string {
+	var failed []string
+	details := make(map[string]error)
+	for i, proxy := range proxies {
+		if errs[i] != nil {
+			failed = append(failed, proxy.config.NodeName)
+			details[proxy.config.NodeName] = errs[i]
+		}
+	}
+	sort.Strings(failed)
+
+	lines := []string{fmt.Sprintf("Startup summary: total=%d started=%d failed=%d failed_nodes=%s",
+		len(proxies), len(proxies)-len(failed), len(failed), strings.Join(failed, ","))}
+	for _, name := range failed {
+		lines = append(lines, fmt.Sprintf("Startup failure: node=%s error=%q", name, details[name].Error()))
+	}
+	return lines
+}
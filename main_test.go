@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStartupSummary(t *testing.T) {
+	proxies := []*Proxy{
+		NewProxy(&ServiceConfig{NodeName: "web"}, &TailscaleConfig{}),
+		NewProxy(&ServiceConfig{NodeName: "db"}, &TailscaleConfig{}),
+		NewProxy(&ServiceConfig{NodeName: "api"}, &TailscaleConfig{}),
+	}
+
+	got := startupSummary(proxies, []error{errors.New("invalid target"), nil, errors.New("listen failed")})
+	want := []string{
+		"Startup summary: total=3 started=1 failed=2 failed_nodes=api,web",
+		`Startup failure: node=api error="listen failed"`,
+		`Startup failure: node=web error="invalid target"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("startupSummary() = %q, want %q", got, want)
+	}
+
+	got = startupSummary(proxies, make([]error, len(proxies)))
+	want = []string{"Startup summary: total=3 started=3 failed=0 failed_nodes="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("startupSummary() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// currentConfigVersion is the config schema version this build understands
+const currentConfigVersion = 1
+
+// configMigrations upgrade a config from the version at their index to the
+// next one, returning a warning for each setting they rewrite so it can be
+// updated in the file. New settings are optional with defaults, so migrations
+// only need to handle renamed or reinterpreted ones.
+var configMigrations = []func(*Config) []string{
+	// Version 0 covers configs written before the version field existed,
+	// whose schema is the same as version 1, so they are stamped silently
+	func(config *Config) []string {
+		return nil
+	},
+}
+
+// migrateConfig upgrades an older config to currentConfigVersion in place
+func migrateConfig(config *Config) ([]string, error) {
+	if config.Version < 0 || config.Version > currentConfigVersion {
+		return nil, fmt.Errorf("unsupported config version %d (this webtail supports up to %d, upgrade it)", config.Version, currentConfigVersion)
+	}
+
+	var warnings []string
+	for config.Version < currentConfigVersion {
+		warnings = append(warnings, configMigrations[config.Version](config)...)
+		config.Version++
+	}
+	return warnings, nil
+}
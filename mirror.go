@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// newMirrorTransport creates the transport mirrored requests are sent with. It is
+// separate from the primary's so mirror dials don't end first_request_retries
+// and mirror traffic doesn't spend the primary's retry budget.
+func (p *Proxy) newMirrorTransport() (*http.Transport, error) {
+	config := *p.config
+	config.FirstRequestRetries = 0
+	return newTransport(&config, p.dialContext, nil)
+}
+
+// mirrorRequest sends a copy of a request without a body to the service's mirror
+// target in the background; the response is discarded and errors are only logged
+func (p *Proxy) mirrorRequest(r *http.Request) {
+	// Only safe requests are mirrored so the shadow backend can't cause side effects twice
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		return
+	}
+
+	mirrorURL, err := parseTarget(p.config.MirrorTarget)
+	if err != nil {
+		p.logf(levelError, "Failed to parse mirror target URL %s: %v", p.config.MirrorTarget, err)
+		return
+	}
+
+	// A slow mirror must not pile up goroutines; excess requests aren't mirrored
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		p.logf(levelDebug, "Too many mirror requests in flight for %s, not mirroring %s %s", p.config.NodeName, r.Method, r.URL.Path)
+		return
+	}
+
+	// Handlers can outlive Stop, so new mirror requests are refused once it started waiting
+	p.mirrorMu.Lock()
+	if p.mirrorStopped {
+		p.mirrorMu.Unlock()
+		<-p.mirrorSlots
+		return
+	}
+	p.mirrorWG.Add(1)
+	p.mirrorMu.Unlock()
+
+	// Detach from the client request so mirroring isn't cut short when the primary
+	// responds, but stop with the proxy
+	ctx, cancel := context.WithTimeout(p.ctx, mirrorTimeout)
+	mirror := r.Clone(ctx)
+	mirror.URL.Scheme = mirrorURL.Scheme
+	mirror.URL.Host = mirrorURL.Host
+	mirror.Host = ""
+	mirror.RequestURI = ""
+
+	go func() {
+		defer p.mirrorWG.Done()
+		defer func() { <-p.mirrorSlots }()
+		defer cancel()
+
+		resp, err := p.mirrorTransport.RoundTrip(mirror)
+		if err != nil {
+			p.mirrorErrors.Add(1)
+			p.logf(levelWarn, "Mirror request %s %s for %s failed: %v", mirror.Method, mirror.URL.Path, p.config.NodeName, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// stopMirroring refuses new mirror requests and waits for those in flight
+func (p *Proxy) stopMirroring() {
+	p.mirrorMu.Lock()
+	p.mirrorStopped = true
+	p.mirrorMu.Unlock()
+
+	p.mirrorWG.Wait()
+	if p.mirrorTransport != nil {
+		p.mirrorTransport.CloseIdleConnections()
+	}
+}
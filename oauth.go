@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// oauthKeyExpiry is the lifetime of minted auth keys; they are only used once, to register a node
+	oauthKeyExpiry = 10 * time.Minute
+
+	// oauthTimeout bounds minting an auth key through the Tailscale API
+	oauthTimeout = 30 * time.Second
+)
+
+// tailscaleAPIURL is the base URL of the Tailscale API used to mint auth keys
+var tailscaleAPIURL = "https://api.tailscale.com"
+
+// usesOAuth reports whether auth keys are minted with an OAuth client
+func (c *TailscaleConfig) usesOAuth() bool {
+	return c.OAuthClientID != ""
+}
+
+// authKey returns the auth key for bringing up the proxy's node. With an OAuth
+// client, a single-use key is minted for nodes that have no saved state yet.
+func (p *Proxy) authKey() (string, error) {
+	if !p.tsConfig.usesOAuth() || p.tsConfig.hasNodeState(p.config.NodeName) {
+		return p.tsConfig.AuthKey, nil
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, oauthTimeout)
+	defer cancel()
+
+	key, err := mintAuthKey(ctx, p.tsConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to mint auth key for %s: %w", p.config.NodeName, err)
+	}
+	p.logf(levelInfo, "Minted auth key for %s with tags %s", p.config.NodeName, strings.Join(p.tsConfig.OAuthTags, ","))
+	return key, nil
+}
+
+// mintAuthKey exchanges the OAuth client credentials for an access token and
+// creates a short-lived, single-use, preauthorized auth key with it
+func mintAuthKey(ctx context.Context, config *TailscaleConfig) (string, error) {
+	form := url.Values{
+		"client_id":     {config.OAuthClientID},
+		"client_secret": {config.OAuthClientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tailscaleAPIURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doTailscaleAPI(req, &token); err != nil {
+		return "", fmt.Errorf("oauth token: %w", err)
+	}
+
+	var keyRequest struct {
+		Capabilities struct {
+			Devices struct {
+				Create struct {
+					Reusable      bool     `json:"reusable"`
+					Ephemeral     bool     `json:"ephemeral"`
+					Preauthorized bool     `json:"preauthorized"`
+					Tags          []string `json:"tags"`
+				} `json:"create"`
+			} `json:"devices"`
+		} `json:"capabilities"`
+		ExpirySeconds int    `json:"expirySeconds"`
+		Description   string `json:"description"`
+	}
+	create := &keyRequest.Capabilities.Devices.Create
+	create.Ephemeral = config.Ephemeral
+	create.Preauthorized = true
+	create.Tags = config.OAuthTags
+	keyRequest.ExpirySeconds = int(oauthKeyExpiry.Seconds())
+	keyRequest.Description = "webtail"
+
+	body, err := json.Marshal(keyRequest)
+	if err != nil {
+		return "", err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, tailscaleAPIURL+"/api/v2/tailnet/-/keys", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := doTailscaleAPI(req, &key); err != nil {
+		return "", fmt.Errorf("create key: %w", err)
+	}
+	return key.Key, nil
+}
+
+// doTailscaleAPI sends a Tailscale API request and decodes the JSON response into v
+func doTailscaleAPI(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMintAuthKey(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+	})
+	mux.HandleFunc("POST /api/v2/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Capabilities struct {
+				Devices struct {
+					Create struct {
+						Ephemeral     bool     `json:"ephemeral"`
+						Preauthorized bool     `json:"preauthorized"`
+						Tags          []string `json:"tags"`
+					} `json:"create"`
+				} `json:"devices"`
+			} `json:"capabilities"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		create := body.Capabilities.Devices.Create
+		if !create.Ephemeral || !create.Preauthorized || len(create.Tags) != 1 || create.Tags[0] != "tag:webtail" {
+			http.Error(w, "unexpected capabilities", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"key": "tskey-auth-minted"})
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	defer func(url string) { tailscaleAPIURL = url }(tailscaleAPIURL)
+	tailscaleAPIURL = api.URL
+
+	config := &TailscaleConfig{
+		Ephemeral:         true,
+		OAuthClientID:     "client",
+		OAuthClientSecret: "secret",
+		OAuthTags:         []string{"tag:webtail"},
+	}
+	key, err := mintAuthKey(context.Background(), config)
+	if err != nil {
+		t.Fatalf("mintAuthKey() error = %v", err)
+	}
+	if key != "tskey-auth-minted" {
+		t.Errorf("mintAuthKey() = %q, want %q", key, "tskey-auth-minted")
+	}
+
+	config.OAuthClientSecret = "wrong"
+	if _, err := mintAuthKey(context.Background(), config); err == nil {
+		t.Error("mintAuthKey() with wrong secret succeeded, want error")
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/url"
-	"os"
+	"net/http/httputil"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
 	"tailscale.com/tsnet"
 )
 
@@ -21,44 +23,197 @@ type Proxy struct {
 	tsConfig  *TailscaleConfig
 	server    *tsnet.Server
 	forwarder http.Handler
-	listener  net.Listener
+	transport *http.Transport
+	listeners []net.Listener
+	httpSrvs  []*http.Server
+	draining  atomic.Bool
+	ctx       context.Context
 	cancel    context.CancelFunc
 	wg        sync.WaitGroup
+	logLevel  logLevel
+	logFile   *rotatingFile
+	logger    *log.Logger
+
+	pathRoutes   []pathRoute
+	rewriteRules []rewriteRule
+	queue        *requestQueue
+	hostname     string
+	configHash   string
+	breaker      *errorRateBreaker
+	mirrorErrors atomic.Int64
+	retryBudget  *retryBudget
+	dialContext  dialFunc
+	startLimiter startLimiter
+
+	// Mirrored requests have their own transport and are tracked apart from wg,
+	// since request handlers start them and can outlive Stop
+	mirrorTransport *http.Transport
+	mirrorSlots     chan struct{}
+	mirrorMu        sync.Mutex
+	mirrorStopped   bool
+	mirrorWG        sync.WaitGroup
+
+	statusMu sync.Mutex
+	status   ProxyStatus
 }
 
 // NewProxy creates a new proxy instance for a service
 func NewProxy(serviceConfig *ServiceConfig, tsConfig *TailscaleConfig) *Proxy {
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Invalid levels are rejected by config validation; fall back to info for labels
+	level, err := parseLogLevel(serviceConfig.LogLevel)
+	if err != nil {
+		log.Printf("Proxy for %s: %v, using info", serviceConfig.NodeName, err)
+	}
+
+	// Invalid rules are rejected by config validation as well
+	rewriteRules, err := newRewriteRules(serviceConfig.RewriteRules)
+	if err != nil {
+		log.Printf("Proxy for %s: %v, ignoring rewrite rules", serviceConfig.NodeName, err)
+	}
 
 	return &Proxy{
 		config:   serviceConfig,
 		tsConfig: tsConfig,
+		ctx:      ctx,
 		cancel:   cancel,
+		logLevel: level,
+		status:   ProxyStatus{State: StateStopped},
+
+		pathRoutes:   newPathRoutes(serviceConfig.PathRoutes),
+		rewriteRules: rewriteRules,
+		queue:        newRequestQueue(serviceConfig.MaxConcurrentRequests, time.Duration(serviceConfig.QueueTimeout)),
+		breaker:      newErrorRateBreaker(serviceConfig),
+		retryBudget:  newRetryBudget(serviceConfig),
+		mirrorSlots:  make(chan struct{}, maxConcurrentMirrors),
+		configHash:   configChecksum(serviceConfig),
 	}
 }
 
-// Start initializes and starts the proxy server
+// Start initializes and starts the proxy server, retrying up to start_retries
+// times with a doubling backoff
 func (p *Proxy) Start() error {
+	retries := intValue(p.config.StartRetries, 0)
+	backoff := durationValue(p.config.StartRetryBackoff, defaultStartRetryBackoff)
+	dedup := newLogDeduper(time.Duration(p.config.LogDedupWindow))
+	defer func() {
+		if repeats := dedup.flush(); repeats > 0 {
+			p.logf(levelWarn, "Last start error for %s repeated %d times", p.config.NodeName, repeats)
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		p.setStartAttempt(attempt)
+		p.setState(StateStarting, nil)
+		err := p.startLimiter.run(p.ctx, p.start)
+		if err == nil {
+			p.setState(StateRunning, nil)
+			p.logf(levelInfo, "%s", p.effectiveConfig())
+			return nil
+		}
+		p.setState(StateStopped, err)
+		if attempt > retries {
+			return err
+		}
+
+		if ok, repeats := dedup.check(err.Error(), time.Now()); ok {
+			if repeats > 0 {
+				p.logf(levelWarn, "Last start error for %s repeated %d times", p.config.NodeName, repeats)
+			}
+			p.logf(levelWarn, "Failed to start proxy for %s (attempt %d/%d): %v, retrying in %s",
+				p.config.NodeName, attempt, retries+1, err, backoff)
+		}
+		// start closed the listeners of the failed attempt
+		p.listeners, p.httpSrvs = nil, nil
+		select {
+		case <-p.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// SetDialContext makes the proxy connect to its targets with dial instead of
+// dialing them directly, e.g. through a service mesh sidecar. It must be
+// called before Start and takes precedence over source_addr.
+func (p *Proxy) SetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	p.dialContext = dial
+}
+
+// startLimiter is a semaphore bounding how many proxy start attempts run at once
+type startLimiter chan struct{}
+
+// run calls start once a slot is free, holding it until start returns; a nil
+// limiter doesn't limit
+func (l startLimiter) run(ctx context.Context, start func() error) error {
+	if l == nil {
+		return start()
+	}
+	select {
+	case l <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l }()
+	return start()
+}
+
+// SetStartLimiter makes each start attempt wait for a slot of limiter, which is
+// released between retries. It must be called before Start.
+func (p *Proxy) SetStartLimiter(limiter startLimiter) {
+	p.startLimiter = limiter
+}
+
+// start brings up the tsnet node, forwarder and listener
+func (p *Proxy) start() error {
+	if err := p.openLogFile(); err != nil {
+		return err
+	}
+
+	stateDir, err := p.tsConfig.nodeStateDir(p.config.NodeName)
+	if err != nil {
+		return err
+	}
+
+	// An empty control URL makes tsnet use Tailscale's coordination server
+	controlURL := p.config.ControlURL
+	if controlURL == "" {
+		controlURL = p.tsConfig.ControlURL
+	}
+	if controlURL != "" {
+		p.logf(levelInfo, "Using control server %s for %s", controlURL, p.config.NodeName)
+	}
 
-	basedir, err := os.UserConfigDir()
+	authKey, err := p.authKey()
 	if err != nil {
-		return fmt.Errorf("failed to get user config dir: %w", err)
+		return err
 	}
 
 	// Create tsnet server
 	p.server = &tsnet.Server{
-		Hostname:  p.config.NodeName,
-		AuthKey:   p.tsConfig.AuthKey,
-		Ephemeral: p.tsConfig.Ephemeral,
-		UserLogf:  log.Printf,
-		Dir:       fmt.Sprintf("%s/webtail/%s", basedir, p.config.NodeName),
+		Hostname:   p.config.NodeName,
+		AuthKey:    authKey,
+		Ephemeral:  p.tsConfig.Ephemeral,
+		ControlURL: controlURL,
+		UserLogf: func(format string, args ...any) {
+			p.logf(levelInfo, format, args...)
+		},
+		Dir: stateDir,
 	}
 
-	// Start the tsnet server (must use Up() to get domains)
-	_, err = p.server.Up(context.Background())
+	// Nodes without saved state register as new devices, using up the auth key
+	registering := !p.tsConfig.hasNodeState(p.config.NodeName)
+
+	// Start the tsnet server (must use Up() to get domains); stopping the
+	// proxy cancels a node that is still waiting to come up
+	status, err := p.server.Up(p.ctx)
 	if err != nil {
+		p.server.Close()
 		return fmt.Errorf("failed to start tsnet server for %s: %w", p.config.NodeName, err)
 	}
+	p.recordJoin(registering)
 
 	// Get Tailscale domains for header rewriting
 	tsDomains := p.server.CertDomains()
@@ -67,16 +222,21 @@ func (p *Proxy) Start() error {
 		return fmt.Errorf("no Tailscale domain found for %s", p.config.NodeName)
 	}
 
-	passHost := boolValue(p.config.PassHostHeader, false)
-	trustForward := boolValue(p.config.TrustForwardHeader, false)
+	// A target pointing back at this node would forward every request to itself
+	if target, ok := p.selfTarget(tsDomains, status.TailscaleIPs); ok {
+		p.server.Close()
+		return fmt.Errorf("target %s of %s points back at the node itself", target, p.config.NodeName)
+	}
 
-	passHostOpt := forward.PassHostHeader(passHost)
-	rewriterOpt := forward.Rewriter(&forward.HeaderRewriter{
-		TrustForwardHeader: trustForward,
-		Hostname:           tsDomains[0],
-	})
+	if boolValue(p.config.ProvisionCertOnStart, false) {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.provisionCert(tsDomains[0])
+		}()
+	}
 
-	fwd, err := forward.New(passHostOpt, rewriterOpt)
+	fwd, err := p.newForwarder(tsDomains[0])
 	if err != nil {
 		p.server.Close()
 		return fmt.Errorf("failed to create forwarder for %s: %w", p.config.NodeName, err)
@@ -84,86 +244,438 @@ func (p *Proxy) Start() error {
 
 	p.forwarder = fwd
 
-	// Create listener on the tailnet
-	listener, err := p.server.ListenTLS("tcp", ":443")
-	if err != nil {
+	// Create the main HTTPS listener, plus any additional per-port listeners
+	if err := p.listen(":443", p.config.Target); err != nil {
+		p.closeListeners()
 		p.server.Close()
-		return fmt.Errorf("failed to create listener for %s: %w", p.config.NodeName, err)
+		return err
+	}
+	for _, l := range p.config.Listeners {
+		if err := p.listen(fmt.Sprintf(":%d", l.Port), l.Target); err != nil {
+			p.closeListeners()
+			p.server.Close()
+			return err
+		}
+	}
+
+	if lifetime := time.Duration(p.config.MaxConnLifetime); lifetime > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.recycleConnections(lifetime)
+		}()
+	}
+
+	if p.config.WarmupPath != "" {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.warmUp()
+		}()
+	}
+
+	return nil
+}
+
+// listen creates a TLS listener on the tailnet and serves requests on it, forwarding to target
+func (p *Proxy) listen(addr, target string) error {
+	listener, err := p.server.ListenTLS("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to create listener on %s for %s: %w", addr, p.config.NodeName, err)
 	}
-	p.listener = listener
 
-	// Create HTTP server
 	server := &http.Server{
-		Handler: http.HandlerFunc(p.handleRequest),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.forward(w, r, target)
+		}),
 	}
+	p.listeners = append(p.listeners, listener)
+	p.httpSrvs = append(p.httpSrvs, server)
 
 	// Start serving in a goroutine
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		log.Printf("Starting proxy for %s -> %s",
-			p.config.NodeName, p.config.Target)
+		p.logf(levelInfo, "Starting proxy for %s%s -> %s", p.config.NodeName, addr, target)
 
-		if err := server.Serve(p.listener); err != nil && err != http.ErrServerClosed {
-			log.Printf("Server error for %s: %v", p.config.NodeName, err)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.logf(levelError, "Server error for %s%s: %v", p.config.NodeName, addr, err)
+			p.setState(StateUnhealthy, err)
 		}
 	}()
 
 	return nil
 }
 
-// handleRequest forwards the request to the upstream service
+// closeListeners closes all of the proxy's tailnet listeners
+func (p *Proxy) closeListeners() {
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+}
+
+// provisionCert fetches the node's TLS certificate so the first request doesn't wait for it.
+// tsnet caches the certificate in the node's state directory and renews it on use.
+func (p *Proxy) provisionCert(domain string) {
+	lc, err := p.server.LocalClient()
+	if err != nil {
+		p.logf(levelWarn, "Failed to provision certificate for %s: %v", domain, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), certProvisionTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, err := lc.CertPair(ctx, domain); err != nil {
+		p.logf(levelWarn, "Failed to provision certificate for %s: %v", domain, err)
+		return
+	}
+	p.logf(levelInfo, "Provisioned certificate for %s in %s", domain, time.Since(start).Round(time.Millisecond))
+}
+
+// newForwarder creates the HTTP forwarder for the service's upstream
+func (p *Proxy) newForwarder(hostname string) (http.Handler, error) {
+	p.hostname = hostname
+	passHost := boolValue(p.config.PassHostHeader, false)
+	trustForward := boolValue(p.config.TrustForwardHeader, false)
+
+	var originalHostHeader string
+	if boolValue(p.config.ForwardOriginalHost, false) {
+		originalHostHeader = p.config.OriginalHostHeader
+		if originalHostHeader == "" {
+			originalHostHeader = forward.XForwardedHost
+		}
+	}
+
+	passHostOpt := forward.PassHostHeader(passHost)
+	rewriterOpt := forward.Rewriter(&headerRewriter{
+		HeaderRewriter: &forward.HeaderRewriter{
+			TrustForwardHeader: trustForward,
+			Hostname:           hostname,
+		},
+		originalHostHeader: originalHostHeader,
+	})
+
+	responseOpt := forward.ResponseModifier(p.modifyResponse)
+
+	transport, err := newTransport(p.config, p.dialContext, p.retryBudget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+	p.transport = transport
+	if p.config.MirrorTarget != "" {
+		if p.mirrorTransport, err = p.newMirrorTransport(); err != nil {
+			return nil, fmt.Errorf("failed to create mirror transport: %w", err)
+		}
+	}
+	var roundTripper http.RoundTripper = transport
+	if p.config.RedirectMode == redirectModeFollow {
+		roundTripper = newFollowRedirectsTransport(roundTripper)
+	}
+	if boolValue(p.config.RespectRetryAfter, false) {
+		roundTripper = &retryAfterTransport{
+			next:    roundTripper,
+			maxWait: durationValue(p.config.RetryAfterMaxWait, defaultRetryAfterMaxWait),
+			budget:  p.retryBudget,
+		}
+	}
+	if boolValue(p.config.ServerTiming, false) {
+		roundTripper = &serverTimingTransport{next: roundTripper}
+	}
+	transportOpt := forward.RoundTripper(roundTripper)
+	errorOpt := forward.ErrorHandler(utils.ErrorHandlerFunc(p.handleError))
+
+	// The flush interval only applies when streaming; otherwise the forwarder ignores it
+	streamOpt := forward.Stream(boolValue(p.config.StreamResponses, false))
+	flushOpt := forward.StreamingFlushInterval(durationValue(p.config.FlushInterval, defaultFlushInterval))
+
+	var pool httputil.BufferPool
+	if p.config.ResponseBufferSize > 0 {
+		pool = newBufferPool(p.config.ResponseBufferSize)
+	}
+	bufferOpt := forward.BufferPool(pool)
+
+	return forward.New(passHostOpt, rewriterOpt, responseOpt, transportOpt, errorOpt, streamOpt, flushOpt, bufferOpt)
+}
+
+// bufferPool hands out fixed-size buffers for copying response bodies
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// newBufferPool creates a pool of buffers of the given size
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() any { return make([]byte, size) },
+	}}
+}
+
+// Get returns a buffer from the pool
+func (bp *bufferPool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+// Put returns a buffer to the pool
+func (bp *bufferPool) Put(b []byte) {
+	bp.pool.Put(b)
+}
+
+// headerRewriter extends the oxy header rewriter to copy the client's Host into a custom header
+type headerRewriter struct {
+	*forward.HeaderRewriter
+	originalHostHeader string
+}
+
+// Rewrite sets the forwarding headers on the outgoing request
+func (rw *headerRewriter) Rewrite(req *http.Request) {
+	rw.HeaderRewriter.Rewrite(req)
+
+	if rw.originalHostHeader == "" {
+		return
+	}
+	// Keep a value set by a trusted downstream proxy
+	if rw.TrustForwardHeader && req.Header.Get(rw.originalHostHeader) != "" {
+		return
+	}
+	req.Header.Set(rw.originalHostHeader, req.Host)
+}
+
+// handleRequest forwards the request to the service's main target
 func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Parse the target URL
-	targetURL, err := url.Parse(p.config.Target)
+	p.forward(w, r, p.config.Target)
+}
+
+// forward sends the request to the upstream selected by path routing, or to target
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, target string) {
+	// The reserved status prefix is answered by the proxy and never reaches the backend
+	if boolValue(p.config.ServeNodeStatus, false) {
+		prefix := strings.TrimSuffix(p.config.StatusPathPrefix, "/")
+		if prefix == "" {
+			prefix = defaultStatusPathPrefix
+		}
+		if hasPathPrefix(r.URL.Path, prefix) {
+			p.serveNodeStatus(w, r, prefix)
+			return
+		}
+	}
+
+	if p.config.LocalHealthPath != "" && r.URL.Path == p.config.LocalHealthPath {
+		p.serveLocalHealth(w)
+		return
+	}
+
+	if boolValue(p.config.ServerTiming, false) {
+		r = withServerTiming(r)
+	}
+
+	// Requests this node already forwarded came back through a proxy loop
+	if p.isLoop(r) {
+		http.Error(w, "Proxy loop detected", http.StatusLoopDetected)
+		p.logf(levelError, "%s: proxy loop detected for %s %s", p.config.NodeName, r.Method, r.URL.RequestURI())
+		return
+	}
+
+	// Turn away new requests while draining so clients move on
+	if p.draining.Load() {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Service is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Answer CORS preflights directly; backends often don't handle them
+	if p.config.CORS != nil && p.handlePreflight(w, r) {
+		return
+	}
+
+	// Send visitors of the bare node to the backend's entry page
+	if p.config.RootRedirect != "" && r.URL.Path == "/" {
+		redirectRoot(w, r, p.config.RootRedirect)
+		return
+	}
+
+	// Give a failing backend a break once its error rate trips the breaker
+	if p.breaker != nil && !p.breaker.allow() {
+		http.Error(w, "Service is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Shed load once the concurrency cap is hit and the queue timeout expires
+	if p.queue != nil {
+		if !p.queue.acquire(r.Context()) {
+			http.Error(w, "Service is at capacity", http.StatusServiceUnavailable)
+			p.logf(levelWarn, "%s: rejected %s %s, max_concurrent_requests reached", p.config.NodeName, r.Method, r.URL.RequestURI())
+			return
+		}
+		defer p.queue.release()
+	}
+
+	// Select the target, routing by header or path prefix if configured
+	path, rawPath := r.URL.Path, r.URL.RawPath
+	if headerTarget, ok := matchHeaderRoute(p.config.HeaderRoutes, r.Header); ok {
+		target = headerTarget
+	} else if route, ok := matchPathRoute(p.pathRoutes, path); ok {
+		// Backends mounted under a prefix usually expect it with a trailing slash
+		if boolValue(p.config.RedirectTrailingSlash, false) && path != "/" && path == strings.TrimSuffix(route.prefix, "/") {
+			redirectTrailingSlash(w, r)
+			return
+		}
+		target = route.target
+		if boolValue(p.config.StripPathPrefix, false) {
+			path, rawPath = stripPathPrefix(path, route.prefix), ""
+		}
+	}
+	if target == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(p.rewriteRules) > 0 {
+		path, rawPath = rewritePath(p.rewriteRules, path), ""
+	}
+
+	// Parse the target URL (defaults to http if no scheme is specified)
+	targetURL, err := parseTarget(target)
 	if err != nil {
 		http.Error(w, "Invalid target URL", http.StatusInternalServerError)
-		log.Printf("Failed to parse target URL %s: %v", p.config.Target, err)
+		p.logf(levelError, "Failed to parse target URL %s: %v", target, err)
 		return
 	}
 
-	// Preserve the original scheme if not specified
-	if targetURL.Scheme == "" {
-		targetURL.Scheme = "http"
-	}
+	p.logf(levelDebug, "%s: %s %s from %s -> %s", p.config.NodeName, r.Method, r.URL.RequestURI(), r.RemoteAddr, target)
 
-	// Update path and query from the incoming request
-	targetURL.Path = r.URL.Path
+	// Append the request path to the target's base path, and take the query from the request
+	targetURL.Path, targetURL.RawPath = joinURLPath(targetURL, path, rawPath)
 	targetURL.RawQuery = r.URL.RawQuery
+	if len(p.config.QueryParams) > 0 {
+		targetURL.RawQuery = setQueryParams(r.URL.Query(), p.config.QueryParams)
+	}
 
-	// Update the request URL and Host header
+	// Update the request URL; the forwarder sets the Host header based on pass_host_header.
+	// Clear RequestURI so the forwarder uses the rewritten URL rather than the original one.
 	r.URL = targetURL
-	r.Host = targetURL.Host
+	r.RequestURI = ""
+
+	// Record this node so the request is recognized if it comes back
+	r.Header.Add(loopHeader, p.config.NodeName)
+
+	if p.config.MirrorTarget != "" {
+		p.mirrorRequest(r)
+	}
+	if p.config.FallbackTarget != "" {
+		r = p.withFallbackRequest(r)
+	}
+
+	// Let the upstream request run to completion even if the client goes away
+	if !boolValue(p.config.CancelUpstreamOnClientDisconnect, true) {
+		r = r.WithContext(context.WithoutCancel(r.Context()))
+	}
 
 	// Forward the request
+	p.retryBudget.deposit()
 	p.forwarder.ServeHTTP(w, r)
 }
 
+// modifyResponse adjusts upstream responses before they are sent to the client
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	p.recordResult(p.breaker.isFailure(resp.StatusCode))
+
+	if p.config.RedirectMode == redirectModeRewrite {
+		p.rewriteLocation(resp)
+	}
+
+	// Report the certificate of https targets, e.g. to monitor its expiry
+	if boolValue(p.config.ExposeUpstreamCert, false) && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		resp.Header.Set(upstreamCertSubjectHeader, cert.Subject.String())
+		resp.Header.Set(upstreamCertNotAfterHeader, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	if boolValue(p.config.ServerTiming, false) {
+		setServerTiming(resp)
+	}
+
+	if boolValue(p.config.NoCache, false) {
+		cacheControl := p.config.CacheControl
+		if cacheControl == "" {
+			cacheControl = defaultCacheControl
+		}
+		resp.Header.Set("Cache-Control", cacheControl)
+	}
+
+	// Keep the backend's own CORS headers if it sets them
+	if p.config.CORS != nil && resp.Header.Get("Access-Control-Allow-Origin") == "" {
+		setCORSHeaders(resp.Header, p.config.CORS, resp.Request.Header.Get("Origin"))
+	}
+
+	return nil
+}
+
+// Drain puts the proxy into draining mode: in-flight requests complete,
+// new requests are rejected with 503 and connections are not kept alive
+func (p *Proxy) Drain() {
+	if p.draining.Swap(true) {
+		return
+	}
+	for _, server := range p.httpSrvs {
+		server.SetKeepAlivesEnabled(false)
+	}
+	p.setState(StateDraining, nil)
+	p.logf(levelInfo, "Proxy for %s is draining", p.config.NodeName)
+}
+
+// Logout removes the proxy's node from the tailnet, invalidating its saved
+// state; the next start registers a new node
+func (p *Proxy) Logout() {
+	if state := p.Status().State; state != StateRunning && state != StateDraining {
+		return
+	}
+	lc, err := p.server.LocalClient()
+	if err != nil {
+		p.logf(levelWarn, "Failed to log out %s: %v", p.config.NodeName, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	if err := lc.Logout(ctx); err != nil {
+		p.logf(levelWarn, "Failed to log out %s: %v", p.config.NodeName, err)
+		return
+	}
+	p.logf(levelInfo, "Logged out %s from the tailnet", p.config.NodeName)
+}
+
 // Stop gracefully shuts down the proxy
 func (p *Proxy) Stop() error {
 	p.cancel()
 
-	if p.listener != nil {
-		p.listener.Close()
-	}
+	p.closeListeners()
+	p.stopMirroring()
 
 	if p.server != nil {
 		p.server.Close()
 	}
 
-	// Wait for the serving goroutine to finish
+	// Wait for the serving goroutines to finish
 	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
 		close(done)
 	}()
 
+	var err error
 	select {
 	case <-done:
-		log.Printf("Proxy for %s stopped", p.config.NodeName)
-		return nil
+		p.setState(StateStopped, nil)
+		p.logf(levelInfo, "Proxy for %s stopped", p.config.NodeName)
 	case <-time.After(10 * time.Second):
-		log.Printf("Timeout waiting for proxy %s to stop", p.config.NodeName)
-		return fmt.Errorf("timeout stopping proxy for %s", p.config.NodeName)
+		err = fmt.Errorf("timeout stopping proxy for %s", p.config.NodeName)
+		p.setState(StateStopped, err)
+		p.logf(levelWarn, "Timeout waiting for proxy %s to stop", p.config.NodeName)
+	}
+
+	if p.logFile != nil {
+		p.logFile.Close()
 	}
+	return err
 }
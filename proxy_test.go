@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestProxy creates a proxy with a forwarder pointed at the given backend, without a tsnet server
+func newTestProxy(t *testing.T, config ServiceConfig) *Proxy {
+	t.Helper()
+
+	p := NewProxy(&config, &TailscaleConfig{})
+	fwd, err := p.newForwarder("test.tailnet.ts.net")
+	if err != nil {
+		t.Fatalf("newForwarder() error = %v", err)
+	}
+	p.forwarder = fwd
+	return p
+}
+
+func TestHandleRequestHostHeaders(t *testing.T) {
+	type seen struct {
+		host         string
+		originalHost string
+	}
+
+	tests := []struct {
+		name               string
+		passHostHeader     bool
+		forwardOrigHost    bool
+		originalHostHeader string
+		wantOriginalHost   string
+	}{
+		{
+			name:             "rewritten host without original host header",
+			passHostHeader:   false,
+			forwardOrigHost:  false,
+			wantOriginalHost: "",
+		},
+		{
+			name:             "rewritten host with default original host header",
+			passHostHeader:   false,
+			forwardOrigHost:  true,
+			wantOriginalHost: "app.tailnet.ts.net",
+		},
+		{
+			name:               "rewritten host with custom original host header",
+			passHostHeader:     false,
+			forwardOrigHost:    true,
+			originalHostHeader: "X-Original-Host",
+			wantOriginalHost:   "app.tailnet.ts.net",
+		},
+		{
+			name:             "passed host with default original host header",
+			passHostHeader:   true,
+			forwardOrigHost:  true,
+			wantOriginalHost: "app.tailnet.ts.net",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.originalHostHeader
+			if header == "" {
+				header = "X-Forwarded-Host"
+			}
+
+			var got seen
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = seen{host: r.Host, originalHost: r.Header.Get(header)}
+			}))
+			defer backend.Close()
+
+			p := newTestProxy(t, ServiceConfig{
+				Target:              backend.URL,
+				NodeName:            "app",
+				PassHostHeader:      &tt.passHostHeader,
+				ForwardOriginalHost: &tt.forwardOrigHost,
+				OriginalHostHeader:  tt.originalHostHeader,
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil)
+			p.handleRequest(httptest.NewRecorder(), req)
+
+			// The client's Host only reaches the backend when pass_host_header is set
+			wantHost := backend.Listener.Addr().String()
+			if tt.passHostHeader {
+				wantHost = "app.tailnet.ts.net"
+			}
+			if got.host != wantHost {
+				t.Errorf("upstream Host = %q, want %q", got.host, wantHost)
+			}
+			if tt.forwardOrigHost && got.originalHost != tt.wantOriginalHost {
+				t.Errorf("upstream %s = %q, want %q", header, got.originalHost, tt.wantOriginalHost)
+			}
+		})
+	}
+}
+
+func TestHandleRequestDraining(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app"})
+	p.Drain()
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Connection"); got != "close" {
+		t.Errorf("Connection = %q, want %q", got, "close")
+	}
+}
+
+func TestHandleRequestErrorResponses(t *testing.T) {
+	// A closed backend makes every request fail to dial
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+
+	tests := []struct {
+		name           string
+		errorResponses map[string]ErrorResponse
+		wantStatus     int
+		wantBody       string
+	}{
+		{
+			name:       "default bad gateway",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name: "custom dial error response",
+			errorResponses: map[string]ErrorResponse{
+				"dial": {Status: http.StatusServiceUnavailable, Body: "backend is down"},
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "backend is down\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, ServiceConfig{
+				Target:         backend.URL,
+				NodeName:       "app",
+				ErrorResponses: tt.errorResponses,
+			})
+
+			rec := httptest.NewRecorder()
+			p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleErrorUnresolvedHost(t *testing.T) {
+	p := newTestProxy(t, ServiceConfig{Target: "http://app:8080", NodeName: "app"})
+
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "app", IsNotFound: true}}
+	rec := httptest.NewRecorder()
+	p.handleError(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil), err)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHandleRequestPathRoutes(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	grafana := newBackend("grafana")
+	defer grafana.Close()
+	grafanaAPI := newBackend("grafana-api")
+	defer grafanaAPI.Close()
+
+	tests := []struct {
+		name       string
+		strip      bool
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "prefix match", path: "/grafana/login", wantStatus: http.StatusOK, wantBody: "grafana /grafana/login"},
+		{name: "longest prefix wins", path: "/grafana/api/health", wantStatus: http.StatusOK, wantBody: "grafana-api /grafana/api/health"},
+		{name: "exact prefix", path: "/grafana", wantStatus: http.StatusOK, wantBody: "grafana /grafana"},
+		{name: "prefix stripped", strip: true, path: "/grafana/login", wantStatus: http.StatusOK, wantBody: "grafana /login"},
+		{name: "prefix stripped to root", strip: true, path: "/grafana", wantStatus: http.StatusOK, wantBody: "grafana /"},
+		{name: "partial segment not matched", path: "/grafanax", wantStatus: http.StatusNotFound},
+		{name: "unmatched path", path: "/prometheus", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, ServiceConfig{
+				NodeName: "tools",
+				PathRoutes: map[string]string{
+					"/grafana":     grafana.URL,
+					"/grafana/api": grafanaAPI.URL,
+				},
+				StripPathPrefix: &tt.strip,
+			})
+
+			rec := httptest.NewRecorder()
+			p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://tools.tailnet.ts.net"+tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleRequestHeaderRoutes(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	v1 := newBackend("v1")
+	defer v1.Close()
+	v2 := newBackend("v2")
+	defer v2.Close()
+	canary := newBackend("canary")
+	defer canary.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:   v1.URL,
+		NodeName: "api",
+		HeaderRoutes: []HeaderRoute{
+			{Header: "X-API-Version", Value: "2", Target: v2.URL},
+			{Header: "X-Canary", Target: canary.URL},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantBody string
+	}{
+		{name: "no header", wantBody: "v1"},
+		{name: "matching value", headers: map[string]string{"x-api-version": "2"}, wantBody: "v2"},
+		{name: "other value", headers: map[string]string{"X-API-Version": "3"}, wantBody: "v1"},
+		{name: "any value", headers: map[string]string{"X-Canary": "yes"}, wantBody: "canary"},
+		{name: "first match wins", headers: map[string]string{"X-API-Version": "2", "X-Canary": "yes"}, wantBody: "v2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://api.tailnet.ts.net/users", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			p.handleRequest(rec, req)
+
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRootRedirect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", RootRedirect: "/dashboard"})
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/?tab=1", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/dashboard?tab=1" {
+		t.Errorf("root: status = %d, Location = %q, want %d and %q", rec.Code, rec.Header().Get("Location"), http.StatusFound, "/dashboard?tab=1")
+	}
+
+	rec = httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/dashboard", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/dashboard" {
+		t.Errorf("other path: status = %d, body = %q, want forwarded", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleRequestClientDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		cancel     bool
+		wantCancel bool
+	}{
+		{name: "cancel upstream", cancel: true, wantCancel: true},
+		{name: "complete upstream", cancel: false, wantCancel: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canceled := make(chan bool, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					canceled <- true
+				case <-time.After(200 * time.Millisecond):
+					canceled <- false
+				}
+			}))
+			defer backend.Close()
+
+			p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", CancelUpstreamOnClientDisconnect: &tt.cancel})
+
+			// The client goes away shortly after sending the request
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req := httptest.NewRequest(http.MethodPost, "https://app.tailnet.ts.net/orders", nil).WithContext(ctx)
+			p.handleRequest(httptest.NewRecorder(), req)
+
+			if got := <-canceled; got != tt.wantCancel {
+				t.Errorf("upstream canceled = %v, want %v", got, tt.wantCancel)
+			}
+		})
+	}
+}
+
+func TestHandleRequestFallbackTarget(t *testing.T) {
+	// A closed backend makes every request fail to dial
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("maintenance " + r.URL.Path))
+	}))
+	defer fallback.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:         primary.URL,
+		NodeName:       "app",
+		FallbackTarget: fallback.URL,
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "request without body", method: http.MethodGet, wantStatus: http.StatusServiceUnavailable, wantBody: "maintenance /status"},
+		{name: "request with body", method: http.MethodPost, body: "data", wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+
+			rec := httptest.NewRecorder()
+			p.handleRequest(rec, httptest.NewRequest(tt.method, "https://app.tailnet.ts.net/status", body))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleRequestFallbackTargetBreaker(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback")
+	}))
+	defer fallback.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:               primary.URL,
+		NodeName:             "app",
+		FallbackTarget:       fallback.URL,
+		ErrorRateThreshold:   0.5,
+		ErrorRateMinRequests: 2,
+	})
+
+	// Requests the fallback answers successfully don't count as failures
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+		if rec.Body.String() != "fallback" {
+			t.Fatalf("body = %q, want %q", rec.Body.String(), "fallback")
+		}
+	}
+	if p.breaker.Tripped() {
+		t.Error("breaker tripped on requests served by the fallback")
+	}
+}
+
+func TestIsStaleConnection(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "reset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: true},
+		{name: "timeout", err: context.DeadlineExceeded},
+		{name: "canceled", err: context.Canceled},
+		{name: "other", err: errors.New("unexpected EOF")},
+	}
+
+	for _, tt := range tests {
+		if got := isStaleConnection(tt.err); got != tt.want {
+			t.Errorf("%s: isStaleConnection(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHandleRequestMirrorTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "primary")
+	}))
+	defer backend.Close()
+
+	mirrored := make(chan string, 2)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Method + " " + r.URL.RequestURI()
+		io.WriteString(w, "mirror")
+	}))
+	defer mirror.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", MirrorTarget: mirror.URL})
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		rec := httptest.NewRecorder()
+		p.handleRequest(rec, httptest.NewRequest(method, "https://app.tailnet.ts.net/items?page=2", nil))
+		if rec.Body.String() != "primary" {
+			t.Errorf("%s body = %q, want %q", method, rec.Body.String(), "primary")
+		}
+	}
+
+	// Only the GET is mirrored; wait for the background request to finish
+	p.mirrorWG.Wait()
+	close(mirrored)
+	var got []string
+	for request := range mirrored {
+		got = append(got, request)
+	}
+	if len(got) != 1 || got[0] != "GET /items?page=2" {
+		t.Errorf("mirrored requests = %v, want [GET /items?page=2]", got)
+	}
+}
+
+func TestHandleRequestMirrorKeepsFirstRequestRetries(t *testing.T) {
+	// The primary isn't listening yet when the first request arrives
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := reserved.Addr().String()
+	reserved.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer mirror.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:              "http://" + addr,
+		NodeName:            "app",
+		MirrorTarget:        mirror.URL,
+		FirstRequestRetries: 5,
+	})
+	defer p.stopMirroring()
+
+	// The mirror connects right away; the primary only comes up while its first dial is retried
+	primary := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "primary")
+	})}
+	defer primary.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("Listen(%s) error = %v", addr, err)
+			return
+		}
+		primary.Serve(listener)
+	}()
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+		t.Errorf("response = %d %q, want 200 %q; mirror dials must not end the primary's retries", rec.Code, rec.Body.String(), "primary")
+	}
+}
+
+func TestHandleRequestCORS(t *testing.T) {
+	var backendCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls.Add(1)
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:   backend.URL,
+		NodeName: "app",
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"https://dashboard.tailnet.ts.net"},
+			AllowedMethods: []string{http.MethodGet, http.MethodPut},
+		},
+	})
+
+	newRequest := func(method, origin string) *http.Request {
+		r := httptest.NewRequest(method, "https://app.tailnet.ts.net/api", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		}
+		return r
+	}
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, newRequest(http.MethodOptions, "https://dashboard.tailnet.ts.net"))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, PUT" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, "GET, PUT")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, "Content-Type")
+	}
+
+	rec = httptest.NewRecorder()
+	p.handleRequest(rec, newRequest(http.MethodOptions, "https://evil.example.com"))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("preflight from unknown origin status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if calls := backendCalls.Load(); calls != 0 {
+		t.Errorf("backend calls for preflights = %d, want 0", calls)
+	}
+
+	rec = httptest.NewRecorder()
+	p.handleRequest(rec, newRequest(http.MethodGet, "https://dashboard.tailnet.ts.net"))
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.tailnet.ts.net" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "https://dashboard.tailnet.ts.net")
+	}
+}
+
+func TestSetCORSHeaders(t *testing.T) {
+	credentials := true
+	tests := []struct {
+		name            string
+		cors            CORSConfig
+		origin          string
+		wantOrigin      string
+		wantCredentials bool
+		wantVary        bool
+	}{
+		{
+			name:       "any origin",
+			cors:       CORSConfig{AllowedOrigins: []string{"*"}},
+			origin:     "https://dashboard.tailnet.ts.net",
+			wantOrigin: "*",
+		},
+		{
+			name:            "listed origin with credentials",
+			cors:            CORSConfig{AllowedOrigins: []string{"https://dashboard.tailnet.ts.net"}, AllowCredentials: &credentials},
+			origin:          "https://dashboard.tailnet.ts.net",
+			wantOrigin:      "https://dashboard.tailnet.ts.net",
+			wantCredentials: true,
+			wantVary:        true,
+		},
+		{
+			name:     "disallowed origin",
+			cors:     CORSConfig{AllowedOrigins: []string{"https://dashboard.tailnet.ts.net"}, AllowCredentials: &credentials},
+			origin:   "https://evil.example.com",
+			wantVary: true,
+		},
+		{
+			name:     "no origin",
+			cors:     CORSConfig{AllowedOrigins: []string{"https://dashboard.tailnet.ts.net"}},
+			wantVary: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			allowed := setCORSHeaders(header, &tt.cors, tt.origin)
+			if allowed != (tt.wantOrigin != "") {
+				t.Errorf("setCORSHeaders() = %v, want %v", allowed, tt.wantOrigin != "")
+			}
+			if got := header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := header.Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials set = %v, want %v", got, tt.wantCredentials)
+			}
+			if got := header.Get("Vary") == "Origin"; got != tt.wantVary {
+				t.Errorf("Vary: Origin set = %v, want %v", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestHandleRequestNodeStatus(t *testing.T) {
+	var backendCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls.Add(1)
+	}))
+	defer backend.Close()
+
+	serve := true
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", ServeNodeStatus: &serve, StatusPathPrefix: "/_proxy/"})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net"+path, nil))
+		return rec
+	}
+
+	if rec := get("/_proxy/health"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health before start = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	p.setState(StateRunning, nil)
+	if rec := get("/_proxy/health"); rec.Code != http.StatusOK {
+		t.Errorf("health while running = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get("/_proxy/status"); !strings.Contains(rec.Body.String(), `"node_name":"app"`) {
+		t.Errorf("status body = %q, want the proxy status", rec.Body.String())
+	}
+	if calls := backendCalls.Load(); calls != 0 {
+		t.Errorf("backend calls = %d, want 0", calls)
+	}
+
+	get("/health")
+	if calls := backendCalls.Load(); calls != 1 {
+		t.Errorf("backend calls outside the prefix = %d, want 1", calls)
+	}
+}
+
+func TestHandleRequestLocalHealth(t *testing.T) {
+	var backendCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls.Add(1)
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", LocalHealthPath: "/healthz"})
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"healthy":false`) {
+		t.Errorf("health before start = %d %q, want %d and an unhealthy body", rec.Code, rec.Body.String(), http.StatusServiceUnavailable)
+	}
+
+	p.setState(StateRunning, nil)
+	rec = httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodHead, "https://app.tailnet.ts.net/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("HEAD health while running = %d, Content-Type %q, want %d and JSON", rec.Code, rec.Header().Get("Content-Type"), http.StatusOK)
+	}
+	if calls := backendCalls.Load(); calls != 0 {
+		t.Errorf("backend calls = %d, want 0", calls)
+	}
+}
+
+func TestHandleRequestRedirectMode(t *testing.T) {
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, backend.URL+"/new?x=1", http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		mode         string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{mode: "", wantStatus: http.StatusFound, wantLocation: backend.URL + "/new?x=1"},
+		{mode: "rewrite", wantStatus: http.StatusFound, wantLocation: "https://test.tailnet.ts.net/new?x=1"},
+		{mode: "follow", wantStatus: http.StatusOK, wantBody: "/new?x=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", RedirectMode: tt.mode})
+
+			rec := httptest.NewRecorder()
+			p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/old", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleRequestExposeUpstreamCert(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	expose := true
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", ExposeUpstreamCert: &expose})
+	p.transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	cert := backend.Certificate()
+	if got := rec.Header().Get(upstreamCertSubjectHeader); got != cert.Subject.String() {
+		t.Errorf("%s = %q, want %q", upstreamCertSubjectHeader, got, cert.Subject.String())
+	}
+	if got, want := rec.Header().Get(upstreamCertNotAfterHeader), cert.NotAfter.UTC().Format(time.RFC3339); got != want {
+		t.Errorf("%s = %q, want %q", upstreamCertNotAfterHeader, got, want)
+	}
+}
+
+func TestHandleRequestServerTiming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Timing", "db;dur=2")
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	serverTiming := true
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app", ServerTiming: &serverTiming})
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+
+	values := rec.Header().Values("Server-Timing")
+	if len(values) != 2 || values[0] != "db;dur=2" {
+		t.Fatalf("Server-Timing = %q, want the backend's entry followed by webtail's", values)
+	}
+	var upstream, total float64
+	if _, err := fmt.Sscanf(values[1], "upstream;dur=%f, proxy;dur=%f", &upstream, &total); err != nil {
+		t.Fatalf("Server-Timing %q: %v", values[1], err)
+	}
+	if upstream < 10 || total < upstream {
+		t.Errorf("upstream = %.1fms, proxy = %.1fms, want upstream >= 10ms and proxy >= upstream", upstream, total)
+	}
+}
+
+func TestHandleRequestLoopDetection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header.Values(loopHeader), ","))
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app"})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil)
+	req.Header.Set(loopHeader, "gateway")
+	p.handleRequest(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "gateway,app" {
+		t.Errorf("status = %d, %s = %q, want %d and %q", rec.Code, loopHeader, rec.Body.String(), http.StatusOK, "gateway,app")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil)
+	req.Header.Set(loopHeader, "gateway, app")
+	p.handleRequest(rec, req)
+	if rec.Code != http.StatusLoopDetected {
+		t.Errorf("looped request status = %d, want %d", rec.Code, http.StatusLoopDetected)
+	}
+}
+
+func TestSelfTarget(t *testing.T) {
+	domains := []string{"app.tailnet.ts.net"}
+	ips := []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")}
+
+	tests := []struct {
+		name   string
+		config ServiceConfig
+		want   string
+	}{
+		{name: "other host", config: ServiceConfig{Target: "http://app:8080"}},
+		{name: "own domain", config: ServiceConfig{Target: "https://App.tailnet.ts.net."}, want: "https://App.tailnet.ts.net."},
+		{name: "own ipv4", config: ServiceConfig{Target: "http://backend:80", PathRoutes: map[string]string{"/x": "http://100.64.0.1:8080"}}, want: "http://100.64.0.1:8080"},
+		{name: "own ipv6 listener", config: ServiceConfig{Listeners: []ListenerConfig{{Port: 8443, Target: "http://[fd7a:115c:a1e0::1]:80"}}}, want: "http://[fd7a:115c:a1e0::1]:80"},
+		{name: "own domain header route", config: ServiceConfig{Target: "http://app:8080", HeaderRoutes: []HeaderRoute{{Header: "X-V", Target: "app.tailnet.ts.net"}}}, want: "app.tailnet.ts.net"},
+		{name: "other tailnet node", config: ServiceConfig{Target: "https://db.tailnet.ts.net"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.NodeName = "app"
+			p := NewProxy(&tt.config, &TailscaleConfig{})
+			got, ok := p.selfTarget(domains, ips)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("selfTarget() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestQueryParams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:      backend.URL,
+		NodeName:    "app",
+		QueryParams: map[string]string{"api_key": "secret"},
+	})
+
+	rec := httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/search?q=tail+net&api_key=client", nil))
+
+	if want := "api_key=secret&q=tail+net"; rec.Body.String() != want {
+		t.Errorf("upstream query = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestHandleRequestRewriteRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		Target:   backend.URL,
+		NodeName: "legacy",
+		RewriteRules: []RewriteRule{
+			{Pattern: `^/app/(\w+)\.php$`, Replacement: "/${1}"},
+			{Pattern: `^/users/(?P<id>\d+)$`, Replacement: "/profile/${id}"},
+		},
+	})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/app/index.php?page=2", want: "/index?page=2"},
+		{path: "/users/42", want: "/profile/42"},
+		{path: "/static/logo.png", want: "/static/logo.png"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://legacy.tailnet.ts.net"+tt.path, nil))
+
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s: upstream request URI = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL, NodeName: "app"})
+	request := func() {
+		p.handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://app.tailnet.ts.net/", nil))
+	}
+
+	request()
+	request()
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("upstream connections = %d, want 1 reused connection", got)
+	}
+
+	// A recreated container keeps its name but may get a new IP, so the next request must dial again
+	p.CloseIdleConnections()
+	request()
+	if got := conns.Load(); got != 2 {
+		t.Errorf("upstream connections after CloseIdleConnections = %d, want 2", got)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	var requested []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	// The path is joined onto the target's path, and an error status is only logged
+	p := newTestProxy(t, ServiceConfig{Target: backend.URL + "/app", NodeName: "app", WarmupPath: "/healthz"})
+	p.warmUp()
+	if len(requested) != 1 || requested[0] != "GET /app/healthz" {
+		t.Errorf("warm-up requests = %v, want [GET /app/healthz]", requested)
+	}
+
+	// An unreachable backend must not panic or block
+	backend.Close()
+	p.warmUp()
+}
+
+func TestForwardListenerTarget(t *testing.T) {
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("grafana"))
+	}))
+	defer grafana.Close()
+
+	p := newTestProxy(t, ServiceConfig{
+		NodeName:  "tools",
+		Listeners: []ListenerConfig{{Port: 8080, Target: grafana.URL}},
+	})
+
+	rec := httptest.NewRecorder()
+	p.forward(rec, httptest.NewRequest(http.MethodGet, "https://tools.tailnet.ts.net:8080/", nil), grafana.URL)
+	if got := rec.Body.String(); got != "grafana" {
+		t.Errorf("listener body = %q, want %q", got, "grafana")
+	}
+
+	// Without a main target, the default port has nothing to forward to
+	rec = httptest.NewRecorder()
+	p.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://tools.tailnet.ts.net/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("main listener status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestStartLimiter(t *testing.T) {
+	const slots = 2
+	limiter := make(startLimiter, slots)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.run(context.Background(), func() error {
+				n := running.Add(1)
+				for {
+					if old := peak.Load(); n <= old || peak.CompareAndSwap(old, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if got := peak.Load(); got > slots {
+		t.Errorf("concurrent starts = %d, want at most %d", got, slots)
+	}
+
+	// Waiting for a slot ends with the proxy's context
+	limiter <- struct{}{}
+	limiter <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.run(ctx, func() error { return nil }); err == nil {
+		t.Error("run() with all slots taken and a canceled context = nil error, want an error")
+	}
+
+	// A nil limiter doesn't limit
+	var unlimited startLimiter
+	if err := unlimited.run(ctx, func() error { return nil }); err != nil {
+		t.Errorf("run() without a limiter error = %v", err)
+	}
+}
+
+func TestConfigChecksum(t *testing.T) {
+	config := ServiceConfig{Target: "http://app:8080", NodeName: "app", Labels: map[string]string{"env": "prod"}}
+	sum := configChecksum(&config)
+	if !strings.HasPrefix(sum, "sha256:") {
+		t.Fatalf("configChecksum() = %q, want a sha256: checksum", sum)
+	}
+
+	same := config
+	if got := configChecksum(&same); got != sum {
+		t.Errorf("configChecksum() of an identical config = %q, want %q", got, sum)
+	}
+	config.Labels = map[string]string{"env": "staging"}
+	if got := configChecksum(&config); got == sum {
+		t.Error("configChecksum() unchanged after a label change")
+	}
+}
+
+func TestRecordJoin(t *testing.T) {
+	registered, reconnected := nodeJoins.registered.Load(), nodeJoins.reconnected.Load()
+
+	p := NewProxy(&ServiceConfig{NodeName: "app"}, &TailscaleConfig{})
+	p.recordJoin(true)
+	if got := p.Status().Join; got != joinRegistered {
+		t.Errorf("join = %q, want %q", got, joinRegistered)
+	}
+	p.recordJoin(false)
+	if got := p.Status().Join; got != joinReconnected {
+		t.Errorf("join after restart = %q, want %q", got, joinReconnected)
+	}
+
+	if got := nodeJoins.registered.Load() - registered; got != 1 {
+		t.Errorf("registrations = %d, want 1", got)
+	}
+	if got := nodeJoins.reconnected.Load() - reconnected; got != 1 {
+		t.Errorf("reconnections = %d, want 1", got)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	passHost := true
+	p := NewProxy(&ServiceConfig{Target: "https://unifi.webtail:8443", NodeName: "unifi", PassHostHeader: &passHost}, &TailscaleConfig{})
+	p.hostname = "unifi.tailnet.ts.net"
+
+	want := "Proxy config: node=unifi hostname=unifi.tailnet.ts.net target=https://unifi.webtail:8443 protocol=https " +
+		"pass_host_header=true trust_forward_header=false forward_original_host=false no_cache=false"
+	if got := p.effectiveConfig(); got != want {
+		t.Errorf("effectiveConfig() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// requestQueue bounds the number of requests forwarded concurrently; requests
+// over the limit wait up to timeout for a slot
+type requestQueue struct {
+	slots   chan struct{}
+	timeout time.Duration
+	depth   atomic.Int64
+}
+
+// newRequestQueue returns a queue admitting max concurrent requests, or nil if max is 0
+func newRequestQueue(max int, timeout time.Duration) *requestQueue {
+	if max <= 0 {
+		return nil
+	}
+	return &requestQueue{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot and reports whether one was taken before the
+// queue timeout or ctx expired; callers must release taken slots
+func (q *requestQueue) acquire(ctx context.Context) bool {
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if q.timeout <= 0 {
+		return false
+	}
+
+	q.depth.Add(1)
+	defer q.depth.Add(-1)
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire
+func (q *requestQueue) release() {
+	<-q.slots
+}
+
+// Depth returns the number of requests waiting for a slot
+func (q *requestQueue) Depth() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.depth.Load()
+}
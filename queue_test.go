@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestQueue(t *testing.T) {
+	if q := newRequestQueue(0, time.Second); q != nil {
+		t.Fatalf("newRequestQueue(0) = %v, want nil", q)
+	}
+
+	q := newRequestQueue(1, 0)
+	if !q.acquire(context.Background()) {
+		t.Fatal("acquire on empty queue failed")
+	}
+	if q.acquire(context.Background()) {
+		t.Fatal("acquire over the limit without queue_timeout succeeded")
+	}
+	q.release()
+
+	q = newRequestQueue(1, time.Second)
+	q.acquire(context.Background())
+	admitted := make(chan bool)
+	go func() { admitted <- q.acquire(context.Background()) }()
+	for q.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	q.release()
+	if !<-admitted {
+		t.Error("queued request was not admitted after release")
+	}
+	if depth := q.Depth(); depth != 0 {
+		t.Errorf("Depth() = %d after admission, want 0", depth)
+	}
+
+	q = newRequestQueue(1, 10*time.Millisecond)
+	q.acquire(context.Background())
+	if q.acquire(context.Background()) {
+		t.Error("acquire succeeded after queue_timeout")
+	}
+}
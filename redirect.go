@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Redirect modes for a service's redirect_mode
+const (
+	redirectModePass    = "pass"
+	redirectModeFollow  = "follow"
+	redirectModeRewrite = "rewrite"
+)
+
+// redirectModes lists the valid redirect_mode values; empty means pass
+var redirectModes = map[string]bool{
+	"":                  true,
+	redirectModePass:    true,
+	redirectModeFollow:  true,
+	redirectModeRewrite: true,
+}
+
+// maxFollowedRedirects bounds the redirects followed for a single request
+const maxFollowedRedirects = 10
+
+// followRedirectsTransport follows upstream redirects to the same host and
+// returns the final response
+type followRedirectsTransport struct {
+	client *http.Client
+}
+
+// newFollowRedirectsTransport wraps next so redirects are followed server-side
+func newFollowRedirectsTransport(next http.RoundTripper) *followRedirectsTransport {
+	return &followRedirectsTransport{client: &http.Client{
+		Transport: next,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Redirects elsewhere are passed to the client rather than fetched by the proxy
+			if req.URL.Host != via[0].URL.Host || len(via) > maxFollowedRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}}
+}
+
+// RoundTrip sends the request, following redirects to the same upstream
+func (t *followRedirectsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	// Return the underlying error so it is classified like any other upstream error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return resp, err
+}
+
+// rewriteLocation points absolute redirects to the upstream at the node's own
+// hostname, so clients don't follow them to an address they can't reach
+func (p *Proxy) rewriteLocation(resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if location == "" || resp.Request == nil {
+		return
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil || !locationURL.IsAbs() {
+		return
+	}
+	if locationURL.Host != resp.Request.URL.Host && locationURL.Host != resp.Request.Host {
+		return
+	}
+
+	locationURL.Scheme = "https"
+	locationURL.Host = p.hostname
+	if port := listenerPort(resp.Request); port != "" {
+		locationURL.Host += ":" + port
+	}
+	resp.Header.Set("Location", locationURL.String())
+}
+
+// listenerPort returns the port of the listener that accepted the client
+// request, or an empty string for the default HTTPS port
+func listenerPort(r *http.Request) string {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil || port == "443" {
+		return ""
+	}
+	return port
+}
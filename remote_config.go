@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// remoteConfigTimeout bounds how long fetching a remote config may take
+	remoteConfigTimeout = 10 * time.Second
+
+	// remoteConfigAuthEnv names the environment variable holding an optional
+	// "Header-Name: value" sent when fetching a remote config
+	remoteConfigAuthEnv = "WEBTAIL_CONFIG_AUTH_HEADER"
+)
+
+// isRemoteConfig reports whether the config path is an http(s) URL
+func isRemoteConfig(configPath string) bool {
+	return strings.HasPrefix(configPath, "http://") || strings.HasPrefix(configPath, "https://")
+}
+
+// loadRemoteConfig fetches the configuration from a URL, falling back to the
+// last good copy cached on disk if the fetch fails
+func loadRemoteConfig(configURL string, dockerEnabled bool) (*Config, error) {
+	cachePath, cacheErr := remoteConfigCachePath(configURL)
+
+	data, err := fetchRemoteConfig(configURL)
+	if err != nil {
+		if cacheErr != nil {
+			return nil, err
+		}
+		cached, readErr := os.ReadFile(cachePath)
+		if readErr != nil {
+			return nil, err
+		}
+		log.Printf("Warning: %v; using cached config from %s", err, cachePath)
+		return parseConfig(bytes.NewReader(cached), dockerEnabled)
+	}
+
+	config, err := parseConfig(bytes.NewReader(data), dockerEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember the last good config for when the config service is unreachable
+	if cacheErr == nil {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err == nil {
+			err = os.WriteFile(cachePath, data, 0o600)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to cache remote config: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+// fetchRemoteConfig downloads the configuration body from a URL
+func fetchRemoteConfig(configURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, configURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config URL: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if authHeader := os.Getenv(remoteConfigAuthEnv); authHeader != "" {
+		name, value, ok := strings.Cut(authHeader, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s must be in \"Header-Name: value\" form", remoteConfigAuthEnv)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config: unexpected status %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/json" && mediaType != "text/plain") {
+			return nil, fmt.Errorf("unsupported config content type %q", contentType)
+		}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return data, nil
+}
+
+// remoteConfigCachePath returns where the last good config from a URL is stored.
+// Each URL has its own file, so a different URL never falls back to its config.
+func remoteConfigCachePath(configURL string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(configURL))
+	return filepath.Join(cacheDir, "webtail", "remote-config-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testRemoteConfig = `{"version": 1, "tailscale": {"auth_key": "test-key"}, "services": [{"target": "http://localhost:8080", "node_name": "app"}]}`
+
+func TestLoadRemoteConfig(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv(remoteConfigAuthEnv, "Authorization: Bearer secret")
+
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !available {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(testRemoteConfig))
+	}))
+	defer server.Close()
+
+	config, err := loadRemoteConfig(server.URL, false)
+	if err != nil {
+		t.Fatalf("loadRemoteConfig() error = %v", err)
+	}
+	if len(config.Services) != 1 || config.Services[0].NodeName != "app" {
+		t.Errorf("services = %+v, want the app service", config.Services)
+	}
+
+	// A failing config service falls back to the cached copy of the same URL
+	available = false
+	config, err = loadRemoteConfig(server.URL, false)
+	if err != nil {
+		t.Fatalf("loadRemoteConfig() with a 502 error = %v, want the cached config", err)
+	}
+	if len(config.Services) != 1 {
+		t.Errorf("cached services = %+v, want the app service", config.Services)
+	}
+
+	// Another URL must not be served the first URL's cached config
+	if _, err := loadRemoteConfig(server.URL+"/other", false); err == nil {
+		t.Error("loadRemoteConfig() for another URL = nil error, want no fallback to a different URL's cache")
+	}
+}
+
+func TestLoadRemoteConfigUnreachable(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	if _, err := loadRemoteConfig(server.URL, false); err == nil {
+		t.Error("loadRemoteConfig() for an unreachable URL without a cache = nil error, want an error")
+	}
+}
+
+func TestFetchRemoteConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		authHeader  string
+		wantErr     bool
+	}{
+		{name: "json", contentType: "application/json"},
+		{name: "plain text", contentType: "text/plain"},
+		{name: "no content type"},
+		{name: "html", contentType: "text/html", wantErr: true},
+		{name: "malformed auth header", contentType: "application/json", authHeader: "Bearer secret", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(remoteConfigAuthEnv, tt.authHeader)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				} else {
+					w.Header()["Content-Type"] = nil
+				}
+				w.Write([]byte(testRemoteConfig))
+			}))
+			defer server.Close()
+
+			data, err := fetchRemoteConfig(server.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchRemoteConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(data) != testRemoteConfig {
+				t.Errorf("fetchRemoteConfig() = %q, want the served config", data)
+			}
+		})
+	}
+}
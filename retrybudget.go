@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// retryBudget is a token bucket capping retries to a share of original
+// requests: each request adds ratio tokens and each retry takes one, so a
+// broadly failing backend sees its retries throttled instead of its load doubled
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+
+	exhausted atomic.Int64
+}
+
+// newRetryBudget returns the service's retry budget, or nil if retry_budget is unset
+func newRetryBudget(config *ServiceConfig) *retryBudget {
+	if config.RetryBudget <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: config.RetryBudget, tokens: retryBudgetBurst}
+}
+
+// deposit credits the budget for an original request
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetBurst)
+}
+
+// withdraw reports whether a retry fits in the budget, taking a token if it does
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		b.exhausted.Add(1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Exhausted returns how many retries were skipped because the budget ran out
+func (b *retryBudget) Exhausted() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.exhausted.Load()
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(&ServiceConfig{RetryBudget: 0.25})
+
+	// The banked burst is spent first
+	for i := range retryBudgetBurst {
+		if !b.withdraw() {
+			t.Fatalf("withdraw() %d = false, want banked retry", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw() with empty budget = true, want false")
+	}
+
+	// Four requests at 25% earn one retry
+	for range 4 {
+		b.deposit()
+	}
+	if !b.withdraw() {
+		t.Error("withdraw() after 4 requests = false, want true")
+	}
+	if b.withdraw() {
+		t.Error("second withdraw() after 4 requests = true, want false")
+	}
+	if got := b.Exhausted(); got != 2 {
+		t.Errorf("Exhausted() = %d, want 2", got)
+	}
+
+	// Deposits never bank more than the burst
+	for range 1000 {
+		b.deposit()
+	}
+	if b.tokens > retryBudgetBurst {
+		t.Errorf("tokens = %v, want at most %d", b.tokens, retryBudgetBurst)
+	}
+}
+
+func TestRetryBudgetDisabled(t *testing.T) {
+	b := newRetryBudget(&ServiceConfig{})
+	if b != nil {
+		t.Fatalf("newRetryBudget() = %v, want nil without retry_budget", b)
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("withdraw() on nil budget = false, want true")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pathRoute maps a URL path prefix to an upstream target
+type pathRoute struct {
+	prefix string
+	target string
+}
+
+// newPathRoutes returns the configured path routes ordered longest prefix first
+func newPathRoutes(routes map[string]string) []pathRoute {
+	result := make([]pathRoute, 0, len(routes))
+	for prefix, target := range routes {
+		result = append(result, pathRoute{prefix: prefix, target: target})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result
+}
+
+// matchPathRoute returns the route with the longest prefix matching the path
+func matchPathRoute(routes []pathRoute, path string) (pathRoute, bool) {
+	for _, route := range routes {
+		if hasPathPrefix(path, route.prefix) {
+			return route, true
+		}
+	}
+	return pathRoute{}, false
+}
+
+// matchHeaderRoute returns the target of the first route whose header the request sends
+func matchHeaderRoute(routes []HeaderRoute, header http.Header) (string, bool) {
+	for _, route := range routes {
+		for _, value := range header.Values(route.Header) {
+			if route.Value == "" || value == route.Value {
+				return route.Target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// hasPathPrefix reports whether path equals prefix or lies below it,
+// so "/grafana" matches "/grafana/x" but not "/grafanax"
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// stripPathPrefix removes a route prefix from the path, keeping it absolute
+func stripPathPrefix(path, prefix string) string {
+	stripped := strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(stripped, "/") {
+		stripped = "/" + stripped
+	}
+	return stripped
+}
+
+// joinURLPath appends a request path to the target's path with exactly one
+// slash between them, returning the joined path and its escaped form if needed
+func joinURLPath(target *url.URL, path, rawPath string) (string, string) {
+	if target.Path == "" || target.Path == "/" {
+		return path, rawPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if target.RawPath == "" && rawPath == "" {
+		return strings.TrimSuffix(target.Path, "/") + path, ""
+	}
+
+	// Keep escaped characters such as %2F intact on either side
+	request := &url.URL{Path: path, RawPath: rawPath}
+	return strings.TrimSuffix(target.Path, "/") + path,
+		strings.TrimSuffix(target.EscapedPath(), "/") + request.EscapedPath()
+}
+
+// redirectRoot redirects a request for / to path, keeping the query. The
+// redirect is temporary so browsers pick up a changed root_redirect.
+func redirectRoot(w http.ResponseWriter, r *http.Request, path string) {
+	location := path
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// redirectTrailingSlash redirects a request for /prefix to /prefix/, keeping the query
+func redirectTrailingSlash(w http.ResponseWriter, r *http.Request) {
+	location := r.URL.EscapedPath() + "/"
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+
+	// 308 keeps the method and body of non-GET requests
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, location, status)
+}
+
+// setQueryParams adds or overwrites the configured query parameters, keeping
+// the request's others, and returns the encoded query
+func setQueryParams(query url.Values, params map[string]string) string {
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	return query.Encode()
+}
+
+// rewriteRule is a compiled regular-expression path rewrite
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newRewriteRules compiles the configured rewrite rules
+func newRewriteRules(rules []RewriteRule) ([]rewriteRule, error) {
+	result := make([]rewriteRule, 0, len(rules))
+	for i, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite_rules[%d]: invalid pattern %q: %w", i, rule.Pattern, err)
+		}
+		result = append(result, rewriteRule{pattern: pattern, replacement: rule.Replacement})
+	}
+	return result, nil
+}
+
+// rewritePath applies each rule in order to the path, keeping it absolute
+func rewritePath(rules []rewriteRule, path string) string {
+	for _, rule := range rules {
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		target      string
+		path        string
+		rawPath     string
+		wantPath    string
+		wantRawPath string
+	}{
+		{target: "http://app:8080", path: "/users", wantPath: "/users"},
+		{target: "http://app:8080/", path: "/users", wantPath: "/users"},
+		{target: "http://app:8080/api", path: "/users", wantPath: "/api/users"},
+		{target: "http://app:8080/api/", path: "/users", wantPath: "/api/users"},
+		{target: "http://app:8080/api/", path: "/", wantPath: "/api/"},
+		{target: "http://app:8080/api", path: "users", wantPath: "/api/users"},
+		{target: "http://app:8080/api/", path: "/a/b", rawPath: "/a%2Fb", wantPath: "/api/a/b", wantRawPath: "/api/a%2Fb"},
+		{target: "http://app:8080/v%2F1", path: "/users", wantPath: "/v/1/users", wantRawPath: "/v%2F1/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.path, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			gotPath, gotRawPath := joinURLPath(target, tt.path, tt.rawPath)
+			if gotPath != tt.wantPath || gotRawPath != tt.wantRawPath {
+				t.Errorf("joinURLPath() = %q, %q, want %q, %q", gotPath, gotRawPath, tt.wantPath, tt.wantRawPath)
+			}
+		})
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	tests := []struct {
+		method       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{method: http.MethodGet, wantStatus: http.StatusMovedPermanently, wantLocation: "/grafana/?orgId=1"},
+		{method: http.MethodPost, wantStatus: http.StatusPermanentRedirect, wantLocation: "/grafana/?orgId=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			redirectTrailingSlash(rec, httptest.NewRequest(tt.method, "https://tools.tailnet.ts.net/grafana?orgId=1", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
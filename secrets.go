@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolveSecret returns a secret configured inline, as a "${NAME}" reference
+// to an environment variable, or in a file next to it; at most one may be set
+func resolveSecret(name, value, file string) (string, error) {
+	if file != "" {
+		if value != "" {
+			return "", fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_file: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if env, ok := strings.CutPrefix(value, "${"); ok && strings.HasSuffix(env, "}") {
+		env = strings.TrimSuffix(env, "}")
+		secret, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("%s references unset environment variable %s", name, env)
+		}
+		return secret, nil
+	}
+
+	return value, nil
+}
+
+// resolveSecrets replaces secret-bearing config fields with their resolved values
+func resolveSecrets(config *Config) error {
+	authKey, err := resolveSecret("auth_key", config.Tailscale.AuthKey, config.Tailscale.AuthKeyFile)
+	if err != nil {
+		return fmt.Errorf("tailscale: %w", err)
+	}
+	config.Tailscale.AuthKey = authKey
+
+	oauthSecret, err := resolveSecret("oauth_client_secret", config.Tailscale.OAuthClientSecret, config.Tailscale.OAuthClientSecretFile)
+	if err != nil {
+		return fmt.Errorf("tailscale: %w", err)
+	}
+	config.Tailscale.OAuthClientSecret = oauthSecret
+
+	// Proxy URLs and query parameters often carry credentials, so they may
+	// come from the environment or a file too
+	for i := range config.Services {
+		if err := resolveServiceSecrets(&config.Services[i]); err != nil {
+			return fmt.Errorf("service[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// resolveServiceSecrets replaces a service's secret-bearing fields with their resolved values
+func resolveServiceSecrets(service *ServiceConfig) error {
+	httpProxy, err := resolveSecret("http_proxy", service.HTTPProxy, service.HTTPProxyFile)
+	if err != nil {
+		return err
+	}
+	service.HTTPProxy = httpProxy
+
+	socksProxy, err := resolveSecret("socks5_proxy", service.SOCKS5Proxy, service.SOCKS5ProxyFile)
+	if err != nil {
+		return err
+	}
+	service.SOCKS5Proxy = socksProxy
+
+	for name, file := range service.QueryParamFiles {
+		if _, ok := service.QueryParams[name]; ok {
+			return fmt.Errorf("query_params.%s and query_param_files.%s are mutually exclusive", name, name)
+		}
+		if service.QueryParams == nil {
+			service.QueryParams = make(map[string]string, len(service.QueryParamFiles))
+		}
+		resolved, err := resolveSecret("query_param_files."+name, "", file)
+		if err != nil {
+			return err
+		}
+		service.QueryParams[name] = resolved
+	}
+	for name, value := range service.QueryParams {
+		if _, ok := service.QueryParamFiles[name]; ok {
+			continue
+		}
+		resolved, err := resolveSecret("query_params."+name, value, "")
+		if err != nil {
+			return err
+		}
+		service.QueryParams[name] = resolved
+	}
+	return nil
+}
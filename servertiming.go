@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serverTimingKey is the context key holding a request's serverTiming
+type serverTimingKey struct{}
+
+// serverTiming records when the proxy received a request and how long the
+// upstream took to respond to it
+type serverTiming struct {
+	start    time.Time
+	upstream time.Duration
+}
+
+// withServerTiming starts timing a request for the Server-Timing header
+func withServerTiming(r *http.Request) *http.Request {
+	timing := &serverTiming{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, timing))
+}
+
+// serverTimingTransport measures how long the upstream takes to return response headers
+type serverTimingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip forwards the request and records its duration on the request's serverTiming
+func (t *serverTimingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if timing, ok := req.Context().Value(serverTimingKey{}).(*serverTiming); ok {
+		timing.upstream = time.Since(start)
+	}
+	return resp, err
+}
+
+// setServerTiming appends the upstream and total proxy durations, in
+// milliseconds, to the response's Server-Timing header
+func setServerTiming(resp *http.Response) {
+	timing, ok := resp.Request.Context().Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return
+	}
+	resp.Header.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f, proxy;dur=%.1f",
+		durationMillis(timing.upstream), durationMillis(time.Since(timing.start))))
+}
+
+// durationMillis returns d in fractional milliseconds
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
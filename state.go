@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// stateFileName is the file tsnet persists a node's identity and keys in
+const stateFileName = "tailscaled.state"
+
+// How a proxy's node joined the tailnet, as reported in its status
+const (
+	joinRegistered  = "registered"
+	joinReconnected = "reconnected"
+)
+
+// nodeJoins counts node joins since webtail started, by how they joined
+var nodeJoins struct {
+	registered  atomic.Int64
+	reconnected atomic.Int64
+}
+
+// nodeStateDir returns the directory holding a node's tsnet state
+func (c *TailscaleConfig) nodeStateDir(nodeName string) (string, error) {
+	if c.StateDir != "" {
+		return filepath.Join(c.StateDir, nodeName), nil
+	}
+	basedir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user config dir: %w", err)
+	}
+	return filepath.Join(basedir, "webtail", nodeName), nil
+}
+
+// hasNodeState reports whether a node has state from a previous run, so it
+// can reconnect without an auth key
+func (c *TailscaleConfig) hasNodeState(nodeName string) bool {
+	dir, err := c.nodeStateDir(nodeName)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, stateFileName))
+	return err == nil && info.Size() > 0
+}
+
+// canJoin reports whether a node can join the tailnet: nodes with saved state
+// reconnect, while new nodes need an auth key or an OAuth client to register.
+// Without one, tsnet would wait for an interactive login forever.
+func (c *TailscaleConfig) canJoin(nodeName string) bool {
+	return c.AuthKey != "" || c.usesOAuth() || c.hasNodeState(nodeName)
+}
+
+// recordJoin logs and counts how the proxy's node joined the tailnet: as a new
+// device, which consumes an auth key use, or with state from a previous run
+func (p *Proxy) recordJoin(registered bool) {
+	join := joinReconnected
+	if registered {
+		join = joinRegistered
+		nodeJoins.registered.Add(1)
+	} else {
+		nodeJoins.reconnected.Add(1)
+	}
+
+	p.statusMu.Lock()
+	p.status.Join = join
+	p.statusMu.Unlock()
+
+	if registered {
+		p.logf(levelInfo, "Registered %s as a new tailnet node (%d registrations, %d reconnections since start)",
+			p.config.NodeName, nodeJoins.registered.Load(), nodeJoins.reconnected.Load())
+		return
+	}
+	p.logf(levelInfo, "Reconnected %s with its saved state (%d registrations, %d reconnections since start)",
+		p.config.NodeName, nodeJoins.registered.Load(), nodeJoins.reconnected.Load())
+}
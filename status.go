@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ProxyState describes the lifecycle state of a proxy
+type ProxyState string
+
+const (
+	StateStarting  ProxyState = "starting"
+	StateRunning   ProxyState = "running"
+	StateDraining  ProxyState = "draining"
+	StateUnhealthy ProxyState = "unhealthy"
+	StateStopped   ProxyState = "stopped"
+)
+
+// ProxyStatus is a point-in-time snapshot of a proxy's state
+type ProxyStatus struct {
+	NodeName     string            `json:"node_name"`
+	Target       string            `json:"target"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	ConfigHash   string            `json:"config_hash"`
+	State        ProxyState        `json:"state"`
+	StartAttempt int               `json:"start_attempt,omitempty"`
+	Join         string            `json:"join,omitempty"`
+	QueueDepth   int64             `json:"queue_depth,omitempty"`
+	MirrorErrors int64             `json:"mirror_errors,omitempty"`
+
+	// RetryBudgetExhausted counts retries skipped because retry_budget ran out
+	RetryBudgetExhausted int64     `json:"retry_budget_exhausted,omitempty"`
+	Tripped              bool      `json:"tripped,omitempty"`
+	StartedAt            time.Time `json:"started_at,omitempty"`
+	LastError            string    `json:"last_error,omitempty"`
+	LastErrorAt          time.Time `json:"last_error_at,omitempty"`
+}
+
+// Status returns the proxy's current state, start time and last error
+func (p *Proxy) Status() ProxyStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+
+	status := p.status
+	status.NodeName = p.config.NodeName
+	status.Target = p.config.Target
+	status.Labels = p.config.Labels
+	status.ConfigHash = p.configHash
+	status.QueueDepth = p.queue.Depth()
+	status.MirrorErrors = p.mirrorErrors.Load()
+	status.RetryBudgetExhausted = p.retryBudget.Exhausted()
+	status.Tripped = p.breaker.Tripped()
+	return status
+}
+
+// setState records a state transition and, if err is non-nil, the error that caused it
+func (p *Proxy) setState(state ProxyState, err error) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+
+	if state == StateRunning && p.status.State != StateRunning {
+		p.status.StartedAt = time.Now()
+	}
+	p.status.State = state
+	if err != nil {
+		p.status.LastError = err.Error()
+		p.status.LastErrorAt = time.Now()
+	}
+}
+
+// configChecksum returns a SHA-256 checksum of the service's effective config,
+// which changes whenever any setting, including Docker labels, changes
+func configChecksum(config *ServiceConfig) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// setStartAttempt records the number of the current start attempt
+func (p *Proxy) setStartAttempt(attempt int) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.status.StartAttempt = attempt
+}
+
+// healthy reports whether the proxy is running and forwarding requests
+func (s ProxyStatus) healthy() bool {
+	return s.State == StateRunning && !s.Tripped
+}
+
+// localHealth is the body of local_health_path responses
+type localHealth struct {
+	NodeName string     `json:"node_name"`
+	Healthy  bool       `json:"healthy"`
+	State    ProxyState `json:"state"`
+	Tripped  bool       `json:"tripped,omitempty"`
+}
+
+// serveLocalHealth answers the service's local_health_path with the proxy's
+// health, without involving the backend
+func (p *Proxy) serveLocalHealth(w http.ResponseWriter) {
+	status := p.Status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !status.healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(localHealth{
+		NodeName: status.NodeName,
+		Healthy:  status.healthy(),
+		State:    status.State,
+		Tripped:  status.Tripped,
+	})
+}
+
+// serveNodeStatus answers requests under the node's status_path_prefix with the
+// proxy's health or status instead of forwarding them
+func (p *Proxy) serveNodeStatus(w http.ResponseWriter, r *http.Request, prefix string) {
+	status := p.Status()
+	switch r.URL.Path {
+	case prefix + "/health":
+		if !status.healthy() {
+			http.Error(w, string(status.State), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	case prefix + "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// effectiveConfig describes the proxy's resolved target and header settings as
+// one key=value line, so config and label resolution can be checked in the logs
+func (p *Proxy) effectiveConfig() string {
+	protocol := defaultProtocol
+	if targetURL, err := parseTarget(p.config.Target); err == nil {
+		protocol = targetURL.Scheme
+	}
+	return fmt.Sprintf("Proxy config: node=%s hostname=%s target=%s protocol=%s pass_host_header=%t trust_forward_header=%t forward_original_host=%t no_cache=%t",
+		p.config.NodeName, p.hostname, p.config.Target, protocol,
+		boolValue(p.config.PassHostHeader, false),
+		boolValue(p.config.TrustForwardHeader, false),
+		boolValue(p.config.ForwardOriginalHost, false),
+		boolValue(p.config.NoCache, false))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newTransport builds the HTTP transport used to reach a service's upstream,
+// connecting with dial if set; first dial retries draw on budget
+func newTransport(config *ServiceConfig, dial dialFunc, budget *retryBudget) (*http.Transport, error) {
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+
+		// Bind outgoing connections to a specific local address if configured
+		if config.SourceAddr != "" {
+			ip := net.ParseIP(config.SourceAddr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address %q", config.SourceAddr)
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		dial = dialer.DialContext
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	if config.FirstRequestRetries > 0 {
+		transport.DialContext = retryFirstDial(dial, config.FirstRequestRetries, budget)
+	}
+
+	// Reach the target through an egress proxy if configured; the transport
+	// speaks both HTTP CONNECT and SOCKS5
+	egressProxy := config.HTTPProxy
+	if egressProxy == "" {
+		egressProxy = config.SOCKS5Proxy
+	}
+	if egressProxy != "" {
+		proxyURL, err := url.Parse(egressProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress proxy: %w", err)
+		}
+		transport.Proxy = upstreamProxy(proxyURL, config.NoProxy)
+	}
+
+	// Present a client certificate to upstreams that require mutual TLS
+	if config.ClientCertFile != "" {
+		loader := &clientCertLoader{certFile: config.ClientCertFile, keyFile: config.ClientKeyFile}
+		if _, err := loader.GetClientCertificate(nil); err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{
+			GetClientCertificate: loader.GetClientCertificate,
+		}
+	}
+
+	return transport, nil
+}
+
+// upstreamProxy returns a transport Proxy function sending requests through
+// proxyURL, except those to hosts matching a noProxy entry
+func upstreamProxy(proxyURL *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// matchNoProxy reports whether host matches a no_proxy entry: an IP or CIDR
+// containing it, or a host name matching it or one of its subdomains
+func matchNoProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialFunc is the signature of http.Transport.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// retryFirstDial wraps dial so that failed dials are retried with a doubling
+// backoff until the first connection succeeds, e.g. while a backend starts up
+func retryFirstDial(dial dialFunc, retries int, budget *retryBudget) dialFunc {
+	var connected atomic.Bool
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		delay := firstDialRetryDelay
+		for attempt := 0; ; attempt++ {
+			conn, err := dial(ctx, network, addr)
+			if err == nil {
+				connected.Store(true)
+				return conn, nil
+			}
+			if connected.Load() || attempt >= retries || !budget.withdraw() {
+				return nil, err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+// CloseIdleConnections closes pooled upstream connections so new requests dial,
+// and resolve the target, again
+func (p *Proxy) CloseIdleConnections() {
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// recycleConnections closes the transport's idle upstream connections about every
+// interval so they are re-dialed, picking up DNS and container IP changes
+func (p *Proxy) recycleConnections(interval time.Duration) {
+	everyJittered(p.ctx, interval, floatValue(p.config.JitterFraction, defaultJitterFraction), func(time.Time) {
+		p.CloseIdleConnections()
+	})
+}
+
+// retryAfterTransport retries requests answered with 503 and a Retry-After header
+type retryAfterTransport struct {
+	next    http.RoundTripper
+	maxWait time.Duration
+	budget  *retryBudget
+}
+
+// RoundTrip sends the request, waiting and retrying while the upstream asks to retry later
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only requests without a body can be safely replayed
+	replayable := req.Body == nil || req.Body == http.NoBody
+
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusServiceUnavailable || !replayable {
+			return resp, err
+		}
+
+		// A Retry-After of 0 or in the past still waits, so a backend that keeps
+		// answering 503 is neither hammered nor retried forever
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		delay = max(delay, minRetryAfterDelay)
+		if !ok || attempt > maxRetryAfterAttempts || waited+delay > t.maxWait || !t.budget.withdraw() {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		waited += delay
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// clientCertLoader loads a client certificate and reloads it when the files change
+type clientCertLoader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetClientCertificate returns the current client certificate, reloading it if needed
+func (l *clientCertLoader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	modTime, err := latestModTime(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat client certificate: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cert != nil && !modTime.After(l.modTime) {
+		return l.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		// Keep serving the previous certificate if a rotation is half-written
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	l.cert = &cert
+	l.modTime = modTime
+
+	return l.cert, nil
+}
+
+// latestModTime returns the most recent modification time of the given files
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
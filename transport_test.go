@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		maxWait    time.Duration
+		wantStatus int
+		wantCalls  int
+	}{
+		{
+			name:       "retries until upstream is ready",
+			retryAfter: "0",
+			maxWait:    time.Second,
+			wantStatus: http.StatusOK,
+			wantCalls:  3,
+		},
+		{
+			name:       "passes 503 through when wait exceeds cap",
+			retryAfter: "5",
+			maxWait:    time.Second,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCalls:  1,
+		},
+		{
+			name:       "passes 503 through without Retry-After",
+			retryAfter: "",
+			maxWait:    time.Second,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCalls:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls < 3 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer backend.Close()
+
+			transport := &retryAfterTransport{next: http.DefaultTransport, maxWait: tt.maxWait}
+			req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryAfterTransportAlwaysUnavailable(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	// Without a budget, only the wait cap and the attempt limit stop the retries
+	transport := &retryAfterTransport{next: http.DefaultTransport, maxWait: time.Hour}
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip() error = %v", err)
+		}
+		done <- resp
+	}()
+
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RoundTrip() kept retrying a backend that always answers 503 with Retry-After: 0")
+	}
+	if got := calls.Load(); got != maxRetryAfterAttempts+1 {
+		t.Errorf("upstream calls = %d, want %d", got, maxRetryAfterAttempts+1)
+	}
+}
+
+func TestRetryFirstDial(t *testing.T) {
+	refused := errors.New("connection refused")
+	var calls int
+	failures := 2
+	dial := retryFirstDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		calls++
+		if calls <= failures {
+			return nil, refused
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}, 3, nil)
+
+	conn, err := dial(context.Background(), "tcp", "app:8080")
+	if err != nil {
+		t.Fatalf("first dial error = %v, want success after retries", err)
+	}
+	conn.Close()
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+
+	// Once connected, failures are returned right away
+	calls, failures = 0, 1
+	if _, err := dial(context.Background(), "tcp", "app:8080"); !errors.Is(err, refused) {
+		t.Errorf("dial after first connection error = %v, want %v", err, refused)
+	}
+	if calls != 1 {
+		t.Errorf("calls after first connection = %d, want 1", calls)
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	noProxy := []string{"internal.example", ".corp.example", "192.168.1.10", "10.0.0.0/8"}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "internal.example", want: true},
+		{host: "api.internal.example", want: true},
+		{host: "API.Corp.Example", want: true},
+		{host: "corp.example", want: true},
+		{host: "notinternal.example", want: false},
+		{host: "192.168.1.10", want: true},
+		{host: "192.168.1.11", want: false},
+		{host: "10.20.30.40", want: true},
+		{host: "backend.example", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := matchNoProxy(tt.host, noProxy); got != tt.want {
+				t.Errorf("matchNoProxy(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTransportHTTPProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	transport, err := newTransport(&ServiceConfig{HTTPProxy: proxy.URL, NoProxy: []string{"127.0.0.1"}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://backend.invalid/health")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "http://backend.invalid/health" {
+		t.Errorf("proxy received %q, want the absolute target URL", proxied)
+	}
+
+	// no_proxy hosts are dialed directly
+	proxied = ""
+	resp, err = client.Get(proxy.URL + "/direct")
+	if err != nil {
+		t.Fatalf("GET direct: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "/direct" {
+		t.Errorf("direct request URL = %q, want %q", proxied, "/direct")
+	}
+}
+
+func TestNewTransportDialContext(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	// Every target is reached through the dialer, as a sidecar would
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	transport, err := newTransport(&ServiceConfig{SourceAddr: "192.0.2.1"}, dial, nil)
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get("http://backend.mesh:8080/")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if len(dialed) != 1 || dialed[0] != "backend.mesh:8080" {
+		t.Errorf("dialed = %q, want [backend.mesh:8080]", dialed)
+	}
+}
+
+// writeTestCertPair writes a self-signed certificate and its key with the given common name
+func writeTestCertPair(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientCertLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	loader := &clientCertLoader{certFile: certFile, keyFile: keyFile}
+
+	commonName := func() string {
+		t.Helper()
+		cert, err := loader.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetClientCertificate() error = %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("ParseCertificate() error = %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	start := time.Now().Add(-time.Minute)
+	writeTestCertPair(t, certFile, keyFile, "old", start)
+	if got := commonName(); got != "old" {
+		t.Fatalf("initial certificate = %q, want %q", got, "old")
+	}
+
+	// Swapped files with a newer modification time are picked up
+	writeTestCertPair(t, certFile, keyFile, "new", start.Add(time.Second))
+	if got := commonName(); got != "new" {
+		t.Errorf("certificate after swap = %q, want %q", got, "new")
+	}
+
+	// A half-written rotation keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, start.Add(2*time.Second), start.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(); got != "new" {
+		t.Errorf("certificate after partial write = %q, want %q", got, "new")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// warmUp sends a GET for the service's warmup_path to its target so backends
+// that are slow on their first request are ready for the first real one. The
+// result is only logged; a failed warm-up doesn't affect the proxy.
+func (p *Proxy) warmUp() {
+	target, err := parseTarget(p.config.Target)
+	if err != nil {
+		p.logf(levelWarn, "Warm-up request for %s failed: %v", p.config.NodeName, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, warmupTimeout)
+	defer cancel()
+
+	// Like proxied requests, the path is joined onto the target's own path
+	target.Path, target.RawPath = joinURLPath(target, p.config.WarmupPath, "")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		p.logf(levelWarn, "Warm-up request for %s failed: %v", p.config.NodeName, err)
+		return
+	}
+
+	start := time.Now()
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		p.logf(levelWarn, "Warm-up request GET %s for %s failed after %s: %v",
+			p.config.WarmupPath, p.config.NodeName, time.Since(start).Round(time.Millisecond), err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	p.logf(levelInfo, "Warm-up request GET %s for %s returned %d in %s",
+		p.config.WarmupPath, p.config.NodeName, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+}